@@ -0,0 +1,304 @@
+package main
+
+import (
+	"consumer/db"
+	"consumer/kafka"
+	"consumer/services"
+	"consumer/utils"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runCommand runs an admin subcommand in place of the service and returns
+// the process exit code.
+func runCommand(cfg utils.Config, name string, args []string) int {
+	switch name {
+	case "reset-offsets":
+		return resetOffsetsCommand(cfg, args)
+	case "replay":
+		return replayCommand(cfg, args)
+	case "backfill-redis":
+		return backfillRedisCommand(cfg, args)
+	case "sweep-rollups":
+		return sweepRollupsCommand(cfg, args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q, expected reset-offsets, replay, backfill-redis or sweep-rollups\n", name)
+	return 2
+}
+
+// resetOffsetsCommand moves the consumer group, e.g.
+//
+//	consumer reset-offsets -to earliest
+//	consumer reset-offsets -to 2024-05-01T00:00:00Z
+//	consumer reset-offsets -offsets 0=1200,1=980
+func resetOffsetsCommand(cfg utils.Config, args []string) int {
+	flags := flag.NewFlagSet("reset-offsets", flag.ContinueOnError)
+	to := flags.String("to", "", "earliest, latest or an RFC 3339 timestamp")
+	offsets := flags.String("offsets", "", "explicit partition=offset pairs, comma separated")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var reset kafka.OffsetReset
+	switch {
+	case *offsets != "" && *to != "":
+		fmt.Fprintln(os.Stderr, "-to and -offsets are mutually exclusive")
+		return 2
+	case *offsets != "":
+		reset.To = kafka.ResetOffsets
+		reset.Offsets = make(map[int]int64)
+		for _, pair := range strings.Split(*offsets, ",") {
+			partition, offset, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			p, perr := strconv.Atoi(partition)
+			o, oerr := strconv.ParseInt(offset, 10, 64)
+			if !ok || perr != nil || oerr != nil {
+				fmt.Fprintf(os.Stderr, "invalid partition=offset pair %q\n", pair)
+				return 2
+			}
+			reset.Offsets[p] = o
+		}
+	case *to == kafka.ResetEarliest || *to == kafka.ResetLatest:
+		reset.To = *to
+	case *to != "":
+		t, err := time.Parse(time.RFC3339, *to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to %q: want earliest, latest or an RFC 3339 timestamp\n", *to)
+			return 2
+		}
+		reset.To = kafka.ResetTimestamp
+		reset.Time = t
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	committed, err := kafka.ResetGroupOffsets(ctx, cfg, reset)
+	if err != nil {
+		slog.Error("Offset reset failed", "group", cfg.ConsumerGroup, "error", err)
+		return 1
+	}
+	slog.Info("Reset consumer group offsets", "group", cfg.ConsumerGroup, "topic", cfg.KafkaTopic, "to", reset.To)
+	json.NewEncoder(os.Stdout).Encode(committed)
+	return 0
+}
+
+// replayCommand reprocesses a time range into a scratch Mongo database and
+// Redis logical database, then rebuilds the scratch rollups and windows:
+//
+//	consumer replay -from 2024-05-01T00:00:00Z -to 2024-05-02T00:00:00Z
+func replayCommand(cfg utils.Config, args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	fromFlag := flags.String("from", "", "start of the range, RFC 3339 (required)")
+	toFlag := flags.String("to", "", "end of the range, RFC 3339 (default now)")
+	mongoDB := flags.String("mongo-db", cfg.MongoDB+"_replay", "scratch MongoDB database")
+	redisDB := flags.Int("redis-db", 1, "scratch Redis logical database")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	from, err := time.Parse(time.RFC3339, *fromFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from %q: want an RFC 3339 timestamp\n", *fromFlag)
+		return 2
+	}
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		if to, err = time.Parse(time.RFC3339, *toFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to %q: want an RFC 3339 timestamp\n", *toFlag)
+			return 2
+		}
+	}
+	if *mongoDB == cfg.MongoDB || *redisDB == 0 {
+		fmt.Fprintln(os.Stderr, "replay must not write to the live MongoDB database or Redis database 0")
+		return 2
+	}
+
+	mongoClient, err := db.NewMongoClient(cfg.MongoURI, *mongoDB)
+	if err != nil {
+		slog.Error("Failed to connect to MongoDB", "error", err)
+		return 1
+	}
+	defer mongoClient.Disconnect()
+	redisClient, err := db.NewRedisClientDB(cfg.RedisAddr, *redisDB)
+	if err != nil {
+		slog.Error("Failed to connect to Redis", "error", err)
+		return 1
+	}
+	defer redisClient.Close()
+
+	// Partitions are replayed side by side, so one can run ahead of the
+	// others in event time. Lateness covering the whole range keeps every
+	// event in its windows.
+	cfg.Replay = true
+	cfg.AllowedLateness = to.Sub(from) + cfg.WatermarkLag
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Starting replay", "from", from, "to", to, "mongo_db", *mongoDB, "redis_db", *redisDB)
+	stats, err := kafka.Replay(ctx, cfg, mongoClient, redisClient, from, to)
+	if err != nil {
+		slog.Error("Replay failed", "error", err, "read", stats.Read)
+		return 1
+	}
+
+	if err := services.FlushWindows(ctx, cfg, mongoClient); err != nil {
+		slog.Error("Failed to store replayed windows", "error", err)
+		return 1
+	}
+	services.EnsureQueryIndexes(mongoClient)
+	buckets, err := services.SweepRollups(ctx, mongoClient, from.Truncate(time.Hour), to)
+	if err != nil {
+		slog.Error("Failed to rebuild replayed rollups", "error", err)
+		return 1
+	}
+
+	slog.Info("Replay finished", "read", stats.Read, "processed", stats.Processed,
+		"failed", stats.Failed, "invalid", stats.Invalid, "rollup_buckets", buckets)
+	json.NewEncoder(os.Stdout).Encode(stats)
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// backfillRedisCommand rebuilds the Redis analytics counters and recent sets
+// from click_events after Redis lost them, e.g.
+//
+//	consumer backfill-redis -from 2024-05-01T00:00:00Z -dry-run
+func backfillRedisCommand(cfg utils.Config, args []string) int {
+	flags := flag.NewFlagSet("backfill-redis", flag.ContinueOnError)
+	fromFlag := flags.String("from", "", "start of the range, RFC 3339 (default 8 days ago)")
+	toFlag := flags.String("to", "", "end of the range, RFC 3339 (default now)")
+	ads := flags.String("ads", "", "comma separated ad IDs (default every ad with events in the range)")
+	workers := flags.Int("workers", 8, "ads rebuilt in parallel")
+	dryRun := flags.Bool("dry-run", false, "compute the keys without writing them")
+	progressEvery := flags.Duration("progress", 5*time.Second, "progress log interval")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := services.BackfillOptions{
+		From:    time.Now().UTC().Add(-8 * 24 * time.Hour),
+		To:      time.Now().UTC(),
+		Workers: *workers,
+		DryRun:  *dryRun,
+	}
+	var err error
+	if *fromFlag != "" {
+		if opts.From, err = time.Parse(time.RFC3339, *fromFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -from %q: want an RFC 3339 timestamp\n", *fromFlag)
+			return 2
+		}
+	}
+	if *toFlag != "" {
+		if opts.To, err = time.Parse(time.RFC3339, *toFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to %q: want an RFC 3339 timestamp\n", *toFlag)
+			return 2
+		}
+	}
+	for _, id := range strings.Split(*ads, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			opts.AdIDs = append(opts.AdIDs, id)
+		}
+	}
+
+	mongoClient, err := db.NewMongoClient(cfg.MongoURI, cfg.MongoDB)
+	if err != nil {
+		slog.Error("Failed to connect to MongoDB", "error", err)
+		return 1
+	}
+	defer mongoClient.Disconnect()
+	redisClient, err := db.NewRedisClient(cfg.RedisAddr)
+	if err != nil {
+		slog.Error("Failed to connect to Redis", "error", err)
+		return 1
+	}
+	defer redisClient.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Starting Redis backfill", "from", opts.From, "to", opts.To, "ads", len(opts.AdIDs), "dry_run", opts.DryRun)
+	var stats services.BackfillStats
+	done := make(chan error, 1)
+	go func() { done <- services.BackfillRedis(ctx, mongoClient, redisClient, opts, &stats) }()
+
+	ticker := time.NewTicker(*progressEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s := stats.Snapshot()
+			slog.Info("Backfill progress", "ads_done", s.AdsDone, "ads", s.Ads, "events", s.Events, "keys", s.Keys)
+		case err := <-done:
+			s := stats.Snapshot()
+			if err != nil {
+				slog.Error("Redis backfill failed", "error", err, "ads_done", s.AdsDone, "ads", s.Ads)
+				return 1
+			}
+			slog.Info("Redis backfill finished", "ads", s.Ads, "events", s.Events,
+				"keys", s.Keys, "expired_keys", s.Expired, "dry_run", opts.DryRun)
+			json.NewEncoder(os.Stdout).Encode(s)
+			return 0
+		}
+	}
+}
+
+// sweepRollupsCommand rebuilds the hourly and daily rollups for every ad-hour
+// with events in a range. The service only sweeps ROLLUP_LOOKBACK on startup,
+// so run this once over the full history after deploying rollups, e.g.
+//
+//	consumer sweep-rollups -from 2024-01-01T00:00:00Z
+func sweepRollupsCommand(cfg utils.Config, args []string) int {
+	flags := flag.NewFlagSet("sweep-rollups", flag.ContinueOnError)
+	fromFlag := flags.String("from", "", "start of the range, RFC 3339 (required)")
+	toFlag := flags.String("to", "", "end of the range, RFC 3339 (default now)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	from, err := time.Parse(time.RFC3339, *fromFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from %q: want an RFC 3339 timestamp\n", *fromFlag)
+		return 2
+	}
+	to := time.Now().UTC()
+	if *toFlag != "" {
+		if to, err = time.Parse(time.RFC3339, *toFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -to %q: want an RFC 3339 timestamp\n", *toFlag)
+			return 2
+		}
+	}
+
+	mongoClient, err := db.NewMongoClient(cfg.MongoURI, cfg.MongoDB)
+	if err != nil {
+		slog.Error("Failed to connect to MongoDB", "error", err)
+		return 1
+	}
+	defer mongoClient.Disconnect()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Starting rollup sweep", "from", from, "to", to)
+	buckets, err := services.SweepRollups(ctx, mongoClient, from.Truncate(time.Hour), to)
+	if err != nil {
+		slog.Error("Rollup sweep failed", "error", err, "buckets", buckets)
+		return 1
+	}
+	slog.Info("Rollup sweep finished", "buckets", buckets)
+	json.NewEncoder(os.Stdout).Encode(map[string]int{"buckets": buckets})
+	return 0
+}
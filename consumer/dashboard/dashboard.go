@@ -0,0 +1,26 @@
+// Package dashboard serves the built-in analytics dashboard. Its assets are
+// embedded in the binary and read from the consumer's own analytics
+// endpoints, so it needs no separate deployment.
+package dashboard
+
+import (
+	"embed"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/filesystem"
+)
+
+//go:embed static
+var assets embed.FS
+
+// Handler serves the dashboard assets. Mount it with app.Use so requests
+// below the mount point resolve to files.
+func Handler() fiber.Handler {
+	return filesystem.New(filesystem.Config{
+		Root:       http.FS(assets),
+		PathPrefix: "static",
+		Index:      "index.html",
+		MaxAge:     300,
+	})
+}
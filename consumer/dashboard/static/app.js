@@ -0,0 +1,239 @@
+// Dashboard for the consumer's analytics endpoints. Series and leaderboards
+// are polled; the selected ad's counters are kept current with the
+// /ads/live event stream between polls.
+(function () {
+  "use strict";
+
+  const COLORS = { impressions: "#4c78a8", clicks: "#e45756", completions: "#54a24b" };
+  const GRANULARITY_MS = { minute: 60e3, hour: 3600e3, day: 86400e3 };
+  const SERIES_REFRESH_MS = 60e3;
+  const TOP_REFRESH_MS = 30e3;
+
+  const $ = (id) => document.getElementById(id);
+  const state = { adId: "", series: null, source: null };
+
+  function parseDuration(value) {
+    return parseInt(value, 10) * 3600e3;
+  }
+
+  async function getJSON(url) {
+    const res = await fetch(url);
+    if (!res.ok) {
+      throw new Error(url + ": " + res.status);
+    }
+    return res.json();
+  }
+
+  function formatNumber(n) {
+    return Number(n || 0).toLocaleString();
+  }
+
+  function formatPercent(n) {
+    return Number(n || 0).toFixed(2) + "%";
+  }
+
+  function rates(point) {
+    point.ctr_percentage = point.impressions > 0 ? point.clicks / point.impressions * 100 : 0;
+    point.completion_rate_percentage = point.impressions > 0 ? point.completions / point.impressions * 100 : 0;
+  }
+
+  function renderCards() {
+    const totals = state.series ? state.series.totals : {};
+    $("stat-clicks").textContent = formatNumber(totals.clicks);
+    $("stat-impressions").textContent = formatNumber(totals.impressions);
+    $("stat-ctr").textContent = formatPercent(totals.ctr_percentage);
+    $("stat-completions").textContent = formatNumber(totals.completions);
+    $("stat-completion-rate").textContent = formatPercent(totals.completion_rate_percentage);
+    $("stat-reach").textContent = state.series ? formatNumber(state.series.reach.unique_viewers) : "–";
+  }
+
+  function renderChart() {
+    const canvas = $("chart");
+    const ratio = window.devicePixelRatio || 1;
+    const width = canvas.clientWidth;
+    const height = canvas.clientHeight;
+    canvas.width = width * ratio;
+    canvas.height = height * ratio;
+
+    const ctx = canvas.getContext("2d");
+    ctx.scale(ratio, ratio);
+    ctx.clearRect(0, 0, width, height);
+
+    const points = state.series ? state.series.points : [];
+    if (points.length === 0) {
+      ctx.fillStyle = "#8a8f98";
+      ctx.fillText(state.adId ? "No data" : "Select an ad", 12, 20);
+      return;
+    }
+
+    const pad = { left: 48, right: 12, top: 12, bottom: 24 };
+    const plotW = width - pad.left - pad.right;
+    const plotH = height - pad.top - pad.bottom;
+    let max = 1;
+    for (const p of points) {
+      max = Math.max(max, p.impressions, p.clicks, p.completions);
+    }
+
+    const x = (i) => pad.left + (points.length === 1 ? plotW / 2 : i / (points.length - 1) * plotW);
+    const y = (v) => pad.top + plotH - v / max * plotH;
+
+    ctx.strokeStyle = "#eceef1";
+    ctx.fillStyle = "#8a8f98";
+    ctx.font = "11px sans-serif";
+    for (let i = 0; i <= 4; i++) {
+      const v = max * i / 4;
+      ctx.beginPath();
+      ctx.moveTo(pad.left, y(v));
+      ctx.lineTo(width - pad.right, y(v));
+      ctx.stroke();
+      ctx.fillText(formatNumber(Math.round(v)), 4, y(v) + 4);
+    }
+
+    const step = Math.max(1, Math.ceil(points.length / 8));
+    for (let i = 0; i < points.length; i += step) {
+      const t = new Date(points[i].start);
+      const label = state.series.granularity === "day" ? t.toLocaleDateString() : t.toLocaleTimeString([], { hour: "2-digit", minute: "2-digit" });
+      ctx.fillText(label, x(i) - 16, height - 6);
+    }
+
+    for (const metric of ["impressions", "clicks", "completions"]) {
+      ctx.strokeStyle = COLORS[metric];
+      ctx.lineWidth = 2;
+      ctx.beginPath();
+      points.forEach((p, i) => (i === 0 ? ctx.moveTo(x(i), y(p[metric])) : ctx.lineTo(x(i), y(p[metric]))));
+      ctx.stroke();
+    }
+  }
+
+  async function loadSeries() {
+    if (!state.adId) {
+      state.series = null;
+      renderCards();
+      renderChart();
+      return;
+    }
+    const [span, granularity] = $("range").value.split("|");
+    const to = new Date();
+    const from = new Date(to.getTime() - parseDuration(span));
+    const params = new URLSearchParams({
+      id: state.adId,
+      granularity: granularity,
+      from: from.toISOString().replace(/\.\d+Z$/, "Z"),
+      to: to.toISOString().replace(/\.\d+Z$/, "Z"),
+    });
+    try {
+      state.series = await getJSON("/ads/analytics/series?" + params);
+    } catch (err) {
+      console.error(err);
+      state.series = null;
+    }
+    renderCards();
+    renderChart();
+  }
+
+  // applyLive adds a live delta to the totals and to the bucket holding the
+  // event, opening a new trailing bucket when the event is newer.
+  function applyLive(update) {
+    const series = state.series;
+    if (!series || update.ad_id !== state.adId) {
+      return;
+    }
+    const metric = update.metric;
+    const size = GRANULARITY_MS[series.granularity];
+    const start = Math.floor(new Date(update.timestamp).getTime() / size) * size;
+
+    let point = series.points.find((p) => new Date(p.start).getTime() === start);
+    if (!point) {
+      const last = series.points[series.points.length - 1];
+      if (last && new Date(last.start).getTime() > start) {
+        return;
+      }
+      point = { start: new Date(start).toISOString(), clicks: 0, impressions: 0, completions: 0 };
+      series.points.push(point);
+    }
+    point[metric] += update.delta;
+    series.totals[metric] += update.delta;
+    rates(point);
+    rates(series.totals);
+    renderCards();
+    renderChart();
+  }
+
+  function subscribe() {
+    if (state.source) {
+      state.source.close();
+      state.source = null;
+    }
+    setStatus(false);
+    if (!state.adId) {
+      return;
+    }
+    // EventSource reconnects on its own and sends Last-Event-ID to resume.
+    const source = new EventSource("/ads/live?ids=" + encodeURIComponent(state.adId));
+    source.addEventListener("open", () => setStatus(true));
+    source.addEventListener("error", () => setStatus(false));
+    source.addEventListener("update", (e) => applyLive(JSON.parse(e.data)));
+    state.source = source;
+  }
+
+  function setStatus(live) {
+    const el = $("live-status");
+    el.textContent = live ? "live" : "offline";
+    el.className = "status " + (live ? "live" : "offline");
+  }
+
+  async function loadTopAds() {
+    const metric = $("top-metric").value;
+    const params = new URLSearchParams({ metric: metric, window: $("top-window").value, limit: 20 });
+    let board;
+    try {
+      board = await getJSON("/ads/top?" + params);
+    } catch (err) {
+      console.error(err);
+      return;
+    }
+
+    const body = $("top-ads");
+    body.innerHTML = "";
+    for (const entry of board.entries || []) {
+      const row = document.createElement("tr");
+      const value = metric === "ctr" ? formatPercent(entry.value) : formatNumber(entry.value);
+      for (const text of [entry.rank, entry.ad_id, value]) {
+        const cell = document.createElement("td");
+        cell.textContent = text;
+        row.appendChild(cell);
+      }
+      row.addEventListener("click", () => selectAd(entry.ad_id));
+      body.appendChild(row);
+    }
+
+    const options = $("ad-options");
+    options.innerHTML = "";
+    for (const entry of board.entries || []) {
+      const option = document.createElement("option");
+      option.value = entry.ad_id;
+      options.appendChild(option);
+    }
+  }
+
+  function selectAd(adId) {
+    state.adId = adId.trim();
+    $("ad-id").value = state.adId;
+    const url = new URL(window.location);
+    url.searchParams.set("ad", state.adId);
+    window.history.replaceState(null, "", url);
+    loadSeries();
+    subscribe();
+  }
+
+  $("ad-id").addEventListener("change", (e) => selectAd(e.target.value));
+  $("range").addEventListener("change", loadSeries);
+  $("top-metric").addEventListener("change", loadTopAds);
+  $("top-window").addEventListener("change", loadTopAds);
+  window.addEventListener("resize", renderChart);
+
+  selectAd(new URLSearchParams(window.location.search).get("ad") || "");
+  loadTopAds();
+  setInterval(loadSeries, SERIES_REFRESH_MS);
+  setInterval(loadTopAds, TOP_REFRESH_MS);
+})();
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"consumer/metrics"
 	"context"
 	"fmt"
 	// "strconv"
@@ -28,6 +29,7 @@ func NewMongoClient(uri, dbName string) (*MongoClient, error) {
 	clientOptions.SetMaxPoolSize(10)
 	clientOptions.SetMinPoolSize(5)
 	clientOptions.SetMaxConnIdleTime(30 * time.Second)
+	clientOptions.SetMonitor(metrics.MongoMonitor())
 
 	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
@@ -54,6 +56,11 @@ func (m *MongoClient) Disconnect() {
 	}
 }
 
+// Ping checks the connection to the primary.
+func (m *MongoClient) Ping(ctx context.Context) error {
+	return m.Client.Ping(ctx, nil)
+}
+
 func (mc *MongoClient) GetAllAds() ([]map[string]interface{}, error) {
 	collection := mc.Client.Database("video_ads").Collection("ads")
 	cursor, err := collection.Find(context.TODO(), bson.M{})
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"consumer/metrics"
 	"context"
 	"fmt"
 	"time"
@@ -14,9 +15,15 @@ type RedisClient struct {
 
 
 func NewRedisClient(addr string) (*RedisClient, error) {
+	return NewRedisClientDB(addr, 0)
+}
+
+// NewRedisClientDB connects to logical database index, which keeps a replay's
+// keys apart from the live ones.
+func NewRedisClientDB(addr string, index int) (*RedisClient, error) {
 	rdb := redis.NewClient(&redis.Options{
 		Addr:         addr,
-		DB:           0,
+		DB:           index,
 		PoolSize:     10,
 		MinIdleConns: 5,
 		MaxRetries:   3,
@@ -26,6 +33,8 @@ func NewRedisClient(addr string) (*RedisClient, error) {
 		WriteTimeout: 3 * time.Second,
 		PoolTimeout:  4 * time.Second,
 	})
+	rdb.AddHook(metrics.RedisHook{})
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -36,6 +45,10 @@ func NewRedisClient(addr string) (*RedisClient, error) {
 	return &RedisClient{Client: rdb}, nil
 }
 
+func (r *RedisClient) Ping(ctx context.Context) error {
+    return r.Client.Ping(ctx).Err()
+}
+
 func (r *RedisClient) Get(ctx context.Context, key string) (string, error) {
     return r.Client.Get(ctx, key).Result()
 }
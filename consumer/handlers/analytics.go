@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetAdSeries handles GET /ads/analytics/series?id=&from=&to=&granularity=.
+// from and to are RFC 3339 timestamps; to defaults to now and from to one
+// day before it.
+func GetAdSeries(mongoClient *db.MongoClient, redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		adID := c.Query("id")
+		if adID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "id is required"})
+		}
+
+		granularity := c.Query("granularity", services.GranularityHour)
+		if !services.ValidGranularity(granularity) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "granularity must be minute, hour or day"})
+		}
+
+		from, to, err := parseRange(c, 24*time.Hour)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if to.Sub(from) > services.MaxQueryRange {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Range is too long"})
+		}
+		if services.SeriesBucketCount(from, to, granularity) > services.MaxSeriesPoints {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Range has too many buckets for this granularity"})
+		}
+
+		series, err := services.GetAdSeries(mongoClient, redisClient, adID, from, to, granularity)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to build series", "ad_id", adID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch analytics"})
+		}
+		return c.JSON(series)
+	}
+}
+
+// GetPlayback handles GET /ads/analytics/playback?id=&from=&to=, returning
+// watch-time percentiles and the playback histogram for the range.
+func GetPlayback(mongoClient *db.MongoClient, redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		adID := c.Query("id")
+		if adID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "id is required"})
+		}
+
+		from, to, err := parseRange(c, 24*time.Hour)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if to.Sub(from) > services.MaxQueryRange {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Range is too long"})
+		}
+
+		stats, err := services.GetPlaybackStats(mongoClient, redisClient, adID, from, to)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to build playback stats", "ad_id", adID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch playback stats"})
+		}
+		return c.JSON(stats)
+	}
+}
+
+// GetTopAds handles GET /ads/top?metric=&window=&limit=&campaign_id=,
+// ranking ads on the hourly leaderboards.
+func GetTopAds(redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		metric := c.Query("metric", services.MetricClicks)
+		if !services.ValidLeaderboardMetric(metric) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "metric must be clicks, impressions, completions or ctr"})
+		}
+
+		window, err := time.ParseDuration(c.Query("window", "1h"))
+		if err != nil || window <= 0 || window > services.MaxLeaderboardWindow {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid window"})
+		}
+
+		limit, err := strconv.Atoi(c.Query("limit", "10"))
+		if err != nil || limit <= 0 || limit > 100 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit must be between 1 and 100"})
+		}
+
+		minImpressions, err := strconv.ParseInt(c.Query("min_impressions", "10"), 10, 64)
+		if err != nil || minImpressions < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid min_impressions"})
+		}
+
+		board, err := services.GetTopAds(redisClient, metric, window, limit, c.Query("campaign_id"), minImpressions)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to build leaderboard", "metric", metric, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch top ads"})
+		}
+		return c.JSON(board)
+	}
+}
+
+// parseRange reads the from/to query parameters shared by the range based
+// analytics endpoints.
+func parseRange(c *fiber.Ctx, defaultSpan time.Duration) (time.Time, time.Time, error) {
+	to := time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fiber.NewError(fiber.StatusBadRequest, "Invalid to, expected RFC 3339")
+		}
+		to = t.UTC()
+	}
+
+	from := to.Add(-defaultSpan)
+	if v := c.Query("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return time.Time{}, time.Time{}, fiber.NewError(fiber.StatusBadRequest, "Invalid from, expected RFC 3339")
+		}
+		from = t.UTC()
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fiber.NewError(fiber.StatusBadRequest, "from must be before to")
+	}
+	return from, to, nil
+}
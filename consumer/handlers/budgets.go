@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SaveBudget handles POST /budgets, creating or replacing a budget definition.
+func SaveBudget(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var budget services.Budget
+		if err := c.BodyParser(&budget); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if err := budget.Validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := services.SaveBudget(mongoClient, budget); err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to save budget", "budget_id", budget.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save budget"})
+		}
+		return c.JSON(budget)
+	}
+}
+
+// GetBudget handles GET /budgets/:id, reporting live spend and eligibility.
+func GetBudget(mongoClient *db.MongoClient, redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		status, err := services.GetBudgetStatus(mongoClient, redisClient, c.Params("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Budget not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch budget", "budget_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch budget"})
+		}
+		return c.JSON(status)
+	}
+}
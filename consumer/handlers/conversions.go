@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetConversions handles GET /ads/conversions?id=&window=, reporting
+// attributed conversions and conversion rate for one ad.
+func GetConversions(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		adID := c.Query("id")
+		if adID == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "id is required"})
+		}
+
+		window, err := time.ParseDuration(c.Query("window", "24h"))
+		if err != nil || window <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid window"})
+		}
+
+		report, err := services.GetConversionReport(mongoClient, adID, window)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to build conversion report", "ad_id", adID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch conversions"})
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"consumer/utils"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SaveExperiment handles POST /experiments, creating or replacing an
+// experiment definition.
+func SaveExperiment(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var experiment services.Experiment
+		if err := c.BodyParser(&experiment); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if err := experiment.Validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		err := services.SaveExperiment(mongoClient, experiment)
+		if errors.Is(err, services.ErrExperimentOverlap) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to save experiment", "experiment_id", experiment.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save experiment"})
+		}
+		return c.JSON(experiment)
+	}
+}
+
+func GetExperiment(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		experiment, err := services.GetExperiment(mongoClient, c.Params("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Experiment not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch experiment", "experiment_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch experiment"})
+		}
+		return c.JSON(experiment)
+	}
+}
+
+// GetAssignment handles GET /experiments/:id/assignment?user_id=, returning
+// the variant the user is deterministically bucketed into.
+func GetAssignment(cfg utils.Config, mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		experiment, err := services.GetExperiment(mongoClient, c.Params("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Experiment not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch experiment", "experiment_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch experiment"})
+		}
+
+		userHash := services.HashUserID(cfg.UserHashSalt, c.Query("user_id"), c.IP(), c.Get(fiber.HeaderUserAgent))
+		variant := experiment.Assign(userHash)
+		return c.JSON(fiber.Map{
+			"experiment_id": experiment.ID,
+			"variant_id":    variant.ID,
+			"ad_id":         variant.AdID,
+		})
+	}
+}
+
+// GetExperimentAnalytics handles GET /experiments/:id/analytics?confidence=,
+// reporting per-variant rates, lift and significance against the control.
+func GetExperimentAnalytics(mongoClient *db.MongoClient, redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		confidence, err := strconv.ParseFloat(c.Query("confidence", "0.95"), 64)
+		if err != nil || confidence <= 0 || confidence >= 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid confidence"})
+		}
+
+		report, err := services.GetExperimentReport(mongoClient, redisClient, c.Params("id"), confidence)
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Experiment not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to build experiment report", "experiment_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch experiment analytics"})
+		}
+		return c.JSON(report)
+	}
+}
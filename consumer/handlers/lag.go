@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"consumer/kafka"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetConsumerLag handles GET /admin/lag, returning the latest per-partition
+// lag sample of the consumer group and whether it breaches the thresholds.
+func GetConsumerLag() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		report := kafka.CurrentLag()
+		if report == nil {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Lag has not been measured yet"})
+		}
+		return c.JSON(report)
+	}
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bufio"
+	"consumer/db"
+	"consumer/services"
+	"consumer/utils"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/gofiber/fiber/v2"
+)
+
+func liveAdIDs(ids string) []string {
+	var adIDs []string
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adIDs = append(adIDs, id)
+		}
+	}
+	return adIDs
+}
+
+// LiveSSE handles GET /ads/live?ids=a,b as a Server-Sent Events stream of
+// counter deltas. Reconnecting clients resume from the Last-Event-ID header
+// (or last_event_id parameter); comment lines keep idle proxies open. Streams
+// end when shutdown is closed so they don't hold the server open.
+func LiveSSE(cfg utils.Config, redisClient *db.RedisClient, shutdown <-chan struct{}) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		lastEventID := c.Get("Last-Event-ID", c.Query("last_event_id"))
+		sub, err := services.SubscribeLive(redisClient, liveAdIDs(c.Query("ids")), lastEventID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		c.Set(fiber.HeaderContentType, "text/event-stream")
+		c.Set(fiber.HeaderCacheControl, "no-cache")
+		c.Set(fiber.HeaderConnection, "keep-alive")
+		c.Set("X-Accel-Buffering", "no")
+
+		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+			defer sub.Close()
+
+			fmt.Fprintf(w, "retry: %d\n\n", time.Second.Milliseconds()*3)
+			for _, update := range sub.Replay {
+				writeSSEUpdate(w, update)
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			heartbeat := time.NewTicker(cfg.LiveHeartbeat)
+			defer heartbeat.Stop()
+			for {
+				select {
+				case update, ok := <-sub.Updates:
+					if !ok {
+						return
+					}
+					writeSSEUpdate(w, update)
+				case <-heartbeat.C:
+					fmt.Fprint(w, ": heartbeat\n\n")
+				case <-shutdown:
+					return
+				}
+				// A failed flush means the client went away.
+				if err := w.Flush(); err != nil {
+					return
+				}
+			}
+		})
+		return nil
+	}
+}
+
+func writeSSEUpdate(w *bufio.Writer, update services.LiveUpdate) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: update\ndata: %s\n\n", update.ID, data)
+}
+
+// RequireWebSocket rejects plain HTTP requests to WebSocket routes.
+func RequireWebSocket(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	return c.Next()
+}
+
+// LiveWebSocket handles GET /ads/live/ws?ids=a,b, sending each counter delta
+// as a JSON text message. Clients resume with last_event_id and are pinged
+// every heartbeat interval. The connection is closed as going away when
+// shutdown is closed.
+func LiveWebSocket(cfg utils.Config, redisClient *db.RedisClient, shutdown <-chan struct{}) fiber.Handler {
+	return websocket.New(func(conn *websocket.Conn) {
+		sub, err := services.SubscribeLive(redisClient, liveAdIDs(conn.Query("ids")), conn.Query("last_event_id"))
+		if err != nil {
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+			return
+		}
+		defer sub.Close()
+
+		// Reads only serve to notice the client closing the connection.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for _, update := range sub.Replay {
+			if err := conn.WriteJSON(update); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(cfg.LiveHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case update, ok := <-sub.Updates:
+				if !ok {
+					return
+				}
+				if err := conn.WriteJSON(update); err != nil {
+					slog.Warn("Live websocket write failed", "error", err)
+					return
+				}
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			case <-shutdown:
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// QueryAnalytics handles GET /analytics/query. group_by is a comma separated
+// list of dimensions, every other dimension parameter (e.g. country=US) is an
+// equality filter, and from/to, sort_by, page and page_size shape the result.
+func QueryAnalytics(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		query, err := parseAnalyticsQuery(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err := query.Validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		result, err := services.RunAnalyticsQuery(mongoClient, query)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Analytics query failed", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to run analytics query"})
+		}
+		return c.JSON(result)
+	}
+}
+
+func parseAnalyticsQuery(c *fiber.Ctx) (services.AnalyticsQuery, error) {
+	from, to, err := parseRange(c, 24*time.Hour)
+	if err != nil {
+		return services.AnalyticsQuery{}, err
+	}
+
+	query := services.AnalyticsQuery{
+		From:    from,
+		To:      to,
+		SortBy:  c.Query("sort_by"),
+		Filters: map[string]string{},
+	}
+	for _, d := range strings.Split(c.Query("group_by"), ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			query.GroupBy = append(query.GroupBy, d)
+		}
+	}
+	for key, value := range c.Queries() {
+		if services.IsQueryFilter(key) && value != "" {
+			query.Filters[key] = value
+		}
+	}
+
+	if v := c.Query("page"); v != "" {
+		if query.Page, err = strconv.Atoi(v); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "Invalid page")
+		}
+	}
+	if v := c.Query("page_size"); v != "" {
+		if query.PageSize, err = strconv.Atoi(v); err != nil {
+			return query, fiber.NewError(fiber.StatusBadRequest, "Invalid page_size")
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"consumer/utils"
+	"log/slog"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetReconciliation handles GET /admin/reconciliation, returning the latest
+// comparison of Redis hourly counters with MongoDB.
+func GetReconciliation(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		run, err := services.LatestReconcileRun(mongoClient)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch reconciliation run", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch reconciliation run"})
+		}
+		if run == nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "No reconciliation run yet"})
+		}
+		return c.JSON(run)
+	}
+}
+
+// RunReconciliation handles POST /admin/reconciliation?repair=, running a
+// comparison immediately. repair defaults to RECONCILE_REPAIR.
+func RunReconciliation(cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		repair := cfg.ReconcileRepair
+		if value := c.Query("repair"); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "repair must be true or false"})
+			}
+			repair = b
+		}
+
+		run, err := services.Reconcile(c.UserContext(), cfg, mongoClient, redisClient, repair)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Reconciliation run failed", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Reconciliation run failed"})
+		}
+		return c.JSON(run)
+	}
+}
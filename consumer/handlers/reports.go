@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"consumer/db"
+	"consumer/services"
+	"consumer/utils"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type reportRequest struct {
+	Query  services.AnalyticsQuery `json:"query"`
+	Format string                  `json:"format"`
+}
+
+// CreateReport handles POST /reports, queueing an export of an analytics
+// query. The job runs in the background; poll GET /reports/:id for status.
+func CreateReport(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req reportRequest
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if req.Format == "" {
+			req.Format = services.ReportCSV
+		}
+
+		if err := services.ValidateReportJob(&req.Query, req.Format); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		job, err := services.CreateReportJob(mongoClient, req.Query, req.Format, "")
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to queue report", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue report"})
+		}
+		return c.Status(fiber.StatusAccepted).JSON(job)
+	}
+}
+
+// GetReport handles GET /reports/:id, reporting a job's status.
+func GetReport(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		job, err := services.GetReportJob(mongoClient, c.Params("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch report", "job_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+		}
+		return c.JSON(job)
+	}
+}
+
+// DownloadReport handles GET /reports/:id/download once the job succeeded.
+func DownloadReport(cfg utils.Config, mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		job, err := services.GetReportJob(mongoClient, c.Params("id"))
+		if err == mongo.ErrNoDocuments {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Report not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to fetch report", "job_id", c.Params("id"), "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch report"})
+		}
+		if job.Status != services.ReportSucceeded {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Report is " + job.Status})
+		}
+		return c.Download(services.ReportPath(cfg, job), job.File)
+	}
+}
+
+// SaveReportSchedule handles POST /reports/schedules, creating or replacing a
+// recurring daily or weekly report for a campaign.
+func SaveReportSchedule(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var schedule services.ReportSchedule
+		if err := c.BodyParser(&schedule); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		if err := schedule.Validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		if err := services.SaveReportSchedule(mongoClient, schedule); err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to save report schedule", "schedule_id", schedule.ID, "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save report schedule"})
+		}
+		return c.JSON(schedule)
+	}
+}
+
+// ListReportSchedules handles GET /reports/schedules, optionally filtered by
+// campaign_id.
+func ListReportSchedules(mongoClient *db.MongoClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		schedules, err := services.ListReportSchedules(mongoClient, c.Query("campaign_id"))
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to list report schedules", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list report schedules"})
+		}
+		return c.JSON(schedules)
+	}
+}
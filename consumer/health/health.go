@@ -0,0 +1,104 @@
+// Package health serves the liveness and readiness probes used by
+// docker-compose and orchestrators to gate traffic.
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+// severity orders the statuses so the report carries the worst one.
+var severity = map[string]int{StatusOK: 0, StatusDegraded: 1, StatusUnavailable: 2}
+
+// Check reports whether one dependency is usable. It must return once ctx
+// is done.
+type Check func(ctx context.Context) error
+
+type degradedError struct{ error }
+
+// Degraded marks a check failure as degraded rather than unavailable. It is
+// reported, but the service stays ready since taking it out of rotation
+// would not help. Degraded(nil) is nil.
+func Degraded(err error) error {
+	if err == nil {
+		return nil
+	}
+	return degradedError{err}
+}
+
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type Report struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// Live answers ok whenever the process can serve HTTP. It checks no
+// dependencies, so an outage elsewhere never gets the service restarted.
+func Live() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": StatusOK})
+	}
+}
+
+// Ready runs every check concurrently, each bounded by timeout, and answers
+// 503 with the per-dependency results if any of them is unavailable.
+func Ready(timeout time.Duration, checks map[string]Check) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		report := Run(c.UserContext(), timeout, checks)
+		status := fiber.StatusOK
+		if report.Status == StatusUnavailable {
+			status = fiber.StatusServiceUnavailable
+		}
+		return c.Status(status).JSON(report)
+	}
+}
+
+func Run(ctx context.Context, timeout time.Duration, checks map[string]Check) Report {
+	report := Report{Status: StatusOK, Dependencies: make(map[string]DependencyStatus, len(checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			result := DependencyStatus{Status: StatusOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				result.Status = StatusUnavailable
+				if errors.As(err, &degradedError{}) {
+					result.Status = StatusDegraded
+				}
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Dependencies[name] = result
+			if severity[result.Status] > severity[report.Status] {
+				report.Status = result.Status
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
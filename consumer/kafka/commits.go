@@ -0,0 +1,66 @@
+package kafka
+
+import (
+	"sync"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// commitTracker orders commits for messages processed concurrently. A
+// committed offset covers every earlier message of its partition, so a
+// message is committed only once it and everything fetched before it on
+// the same partition have finished.
+type commitTracker struct {
+	mu         sync.Mutex
+	partitions map[int]*partitionCommits
+}
+
+type partitionCommits struct {
+	// fetched holds the offsets still unfinished or waiting on an earlier
+	// one, in fetch order.
+	fetched  []int64
+	finished map[int64]kafka.Message
+}
+
+func newCommitTracker() *commitTracker {
+	return &commitTracker{partitions: make(map[int]*partitionCommits)}
+}
+
+// fetched registers a message before it is handed to a worker.
+func (t *commitTracker) fetched(message kafka.Message) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.partitions[message.Partition]
+	if p == nil {
+		p = &partitionCommits{finished: make(map[int64]kafka.Message)}
+		t.partitions[message.Partition] = p
+	}
+	p.fetched = append(p.fetched, message.Offset)
+}
+
+// finished marks the message done and returns the latest message of its
+// partition that can now be committed, if any.
+func (t *commitTracker) finished(message kafka.Message) (kafka.Message, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p := t.partitions[message.Partition]
+	if p == nil {
+		return kafka.Message{}, false
+	}
+	p.finished[message.Offset] = message
+
+	var commit kafka.Message
+	ok := false
+	for len(p.fetched) > 0 {
+		done, isDone := p.finished[p.fetched[0]]
+		if !isDone {
+			break
+		}
+		delete(p.finished, p.fetched[0])
+		p.fetched = p.fetched[1:]
+		commit, ok = done, true
+	}
+	return commit, ok
+}
@@ -2,16 +2,23 @@ package kafka
 
 import (
 	"consumer/db"
+	"consumer/logging"
+	"consumer/metrics"
 	"consumer/services"
+	"consumer/tracing"
 	"consumer/utils"
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/segmentio/kafka-go"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 
@@ -21,23 +28,34 @@ type Consumer struct {
 	mongoClient *db.MongoClient
 	redisClient *db.RedisClient
 	wg          sync.WaitGroup
+	commits     *commitTracker
 	config      utils.Config
 }
 
-func StartConsumer(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) error {
-	
+// StartConsumer reads messages until ctx is cancelled and returns nil once
+// in-flight messages have finished, or shutdownCtx is done, and the reader
+// has committed its final offsets. Offsets are committed only for messages
+// whose processing finished, so one still running when shutdownCtx expires
+// is read again on the next start.
+func StartConsumer(ctx, shutdownCtx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) error {
+	startOffset := kafka.LastOffset
+	if cfg.KafkaStartOffset == ResetEarliest {
+		startOffset = kafka.FirstOffset
+	}
+
 	reader := kafka.NewReader(kafka.ReaderConfig{
 		Brokers: strings.Split(cfg.KafkaBroker, ","),
 		GroupID: cfg.ConsumerGroup,
 		Topic:   cfg.KafkaTopic,
 		
-		MinBytes:    1,        
-		MaxBytes:    10e6,     
-		MaxWait:     500 * time.Millisecond, 
-		CommitInterval: 1 * time.Second,   
-		StartOffset:    kafka.LastOffset,   
+		MinBytes:       1,
+		MaxBytes:       10e6,
+		MaxWait:        500 * time.Millisecond,
+		CommitInterval: 1 * time.Second,
+		StartOffset:    startOffset,
+		Dialer:         &kafka.Dialer{ClientID: clientID, Timeout: 10 * time.Second, DualStack: true},
 		ErrorLogger: kafka.LoggerFunc(func(msg string, args ...interface{}) {
-			log.Printf("Kafka Reader Error: "+msg, args...)
+			slog.Error("Kafka reader error", "error", fmt.Sprintf(msg, args...))
 		}),
 
 		Partition: 0, 
@@ -47,78 +65,139 @@ func StartConsumer(ctx context.Context, cfg utils.Config, mongoClient *db.MongoC
 		reader:      reader,
 		mongoClient: mongoClient,
 		redisClient: redisClient,
+		commits:     newCommitTracker(),
 		config:      cfg,
 	}
 
 	defer func() {
-		log.Println("Closing Kafka reader...")
+		if consumer.drain(shutdownCtx) {
+			slog.Info("All processing goroutines completed")
+		} else {
+			slog.Warn("Shutdown deadline passed with messages still processing")
+		}
+		// Close commits the offsets read since the last commit interval.
+		slog.Info("Closing Kafka reader")
 		if err := reader.Close(); err != nil {
-			log.Printf("Error closing reader: %v", err)
+			slog.Error("Error closing reader", "error", err)
 		}
-		consumer.wg.Wait() 
-		log.Println("All processing goroutines completed")
 	}()
 
-	log.Printf("Kafka consumer started. Brokers: %s, Topic: %s, Group: %s", 
-		cfg.KafkaBroker, cfg.KafkaTopic, cfg.ConsumerGroup)
+	slog.Info("Kafka consumer started",
+		"brokers", cfg.KafkaBroker, "topic", cfg.KafkaTopic, "group", cfg.ConsumerGroup)
 
 	messageCount := 0
 	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Context cancelled, stopping consumer...")
-			return ctx.Err()
+			slog.Info("Context cancelled, stopping consumer")
+			return nil
 			
 		default:
 			
 			msgCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 			
-			message, err := reader.ReadMessage(msgCtx)
+			message, err := reader.FetchMessage(msgCtx)
 			cancel()
 			
 			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
 				if err == context.DeadlineExceeded {
 					
 					continue
 				}
-				log.Printf("Error reading Kafka message: %v", err)
+				slog.Error("Error reading Kafka message", "error", err)
 				
 				
 				select {
 				case <-ctx.Done():
-					return ctx.Err()
+					return nil
 				case <-time.After(time.Second):
 					continue
 				}
 			}
 
 			messageCount++
-			log.Printf("Received message #%d from partition %d, offset %d", 
-				messageCount, message.Partition, message.Offset)
+			logging.Events().Debug("Received message",
+				"count", messageCount, "partition", message.Partition, "offset", message.Offset)
+			metrics.ObserveLag(message.Topic, message.Partition, message.Offset, message.HighWaterMark)
 
 			
+			consumer.commits.fetched(message)
 			consumer.wg.Add(1)
 			go consumer.processMessage(message)
 		}
 	}
 }
 
+// drain waits for in-flight messages until ctx is done and reports whether
+// they all finished.
+func (c *Consumer) drain(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// commit marks the message finished and commits the offsets it completes.
+// Failed messages count as finished: processMessage logs and drops them,
+// and holding their offset back would stall the partition.
+func (c *Consumer) commit(message kafka.Message) {
+	next, ok := c.commits.finished(message)
+	if !ok {
+		return
+	}
+	if err := c.reader.CommitMessages(context.Background(), next); err != nil {
+		slog.Error("Failed to commit offset", "partition", next.Partition, "offset", next.Offset, "error", err)
+	}
+}
+
 func (c *Consumer) processMessage(message kafka.Message) {
 	defer c.wg.Done()
+	defer c.commit(message)
+	metrics.WorkersBusy.Inc()
+	defer metrics.WorkersBusy.Dec()
+
+	ctx, span := tracing.Tracer().Start(tracing.Extract(context.Background(), message), "process "+message.Topic,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingDestinationName(message.Topic),
+			semconv.MessagingKafkaMessageOffset(int(message.Offset)),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(message.Partition)),
+		))
+	var err error
+	defer func() { tracing.End(span, err) }()
 
 	var event services.ClickEvent
-	if err := json.Unmarshal(message.Value, &event); err != nil {
-		log.Printf("Failed to unmarshal click event: %v, raw message: %s", err, string(message.Value))
+	if err = json.Unmarshal(message.Value, &event); err != nil {
+		slog.ErrorContext(ctx, "Failed to unmarshal click event", "error", err, "raw", string(message.Value))
+		metrics.MessagesConsumed.WithLabelValues("invalid").Inc()
 		return
 	}
 
-	log.Printf("Processing click event: AdID=%s, IP=%s, PlaybackSeconds=%d", 
-		event.AdID, event.IP, event.PlaybackSeconds)
+	ctx = logging.WithCorrelationID(ctx, event.CorrelationID)
+	logging.Events().InfoContext(ctx, "Processing click event",
+		"ad_id", event.AdID, "partition", message.Partition, "offset", message.Offset, "playback_seconds", event.PlaybackSeconds)
 
-	if err := services.ProcessClickEvent(event, c.mongoClient, c.redisClient); err != nil {
-		log.Printf("Failed to process click event: %v", err)		
+	start := time.Now()
+	err = services.ProcessClickEvent(ctx, event, c.config, c.mongoClient, c.redisClient)
+	metrics.ProcessingDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to process click event", "error", err)
+		metrics.MessagesConsumed.WithLabelValues("failed").Inc()
 		return
 	}
+	metrics.MessagesConsumed.WithLabelValues("processed").Inc()
 
-	log.Printf("Successfully processed click event for AdID: %s", event.AdID)
+	logging.Events().DebugContext(ctx, "Processed click event", "ad_id", event.AdID)
 }
\ No newline at end of file
@@ -0,0 +1,75 @@
+package kafka
+
+import (
+	"consumer/utils"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// clientID identifies this replica's reader among the consumer group's
+// members.
+var clientID = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "consumer"
+	}
+	return "consumer-" + host
+}()
+
+// PingBroker dials the first reachable broker and reads the topic's
+// partitions, which fails if the broker is down or the topic is missing.
+func PingBroker(ctx context.Context, cfg utils.Config) error {
+	var lastErr error
+	for _, broker := range strings.Split(cfg.KafkaBroker, ",") {
+		conn, err := kafka.DialContext(ctx, "tcp", broker)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+		partitions, err := conn.ReadPartitions(cfg.KafkaTopic)
+		conn.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read partitions of %s: %w", cfg.KafkaTopic, err)
+		}
+		if len(partitions) == 0 {
+			return fmt.Errorf("topic %s has no partitions", cfg.KafkaTopic)
+		}
+		return nil
+	}
+	return fmt.Errorf("no broker reachable: %w", lastErr)
+}
+
+// CheckGroupMembership reports an error unless this replica has joined the
+// consumer group and the group is not rebalancing. Members left without a
+// partition, when there are more replicas than partitions, still count.
+func CheckGroupMembership(ctx context.Context, cfg utils.Config) error {
+	client := &kafka.Client{Addr: kafka.TCP(strings.Split(cfg.KafkaBroker, ",")...)}
+	resp, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{cfg.ConsumerGroup}})
+	if err != nil {
+		return fmt.Errorf("failed to describe group %s: %w", cfg.ConsumerGroup, err)
+	}
+	if len(resp.Groups) == 0 {
+		return fmt.Errorf("group %s not found", cfg.ConsumerGroup)
+	}
+
+	group := resp.Groups[0]
+	if group.Error != nil {
+		return fmt.Errorf("failed to describe group %s: %w", cfg.ConsumerGroup, group.Error)
+	}
+	if group.GroupState != "Stable" {
+		return fmt.Errorf("group %s is %s", cfg.ConsumerGroup, group.GroupState)
+	}
+	for _, member := range group.Members {
+		if member.ClientID == clientID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a member of group %s", clientID, cfg.ConsumerGroup)
+}
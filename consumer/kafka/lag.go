@@ -0,0 +1,192 @@
+package kafka
+
+import (
+	"consumer/metrics"
+	"consumer/utils"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// PartitionLag is how far the group's committed offset trails the newest
+// message of one partition.
+type PartitionLag struct {
+	Partition       int   `json:"partition"`
+	HighWaterMark   int64 `json:"high_water_mark"`
+	CommittedOffset int64 `json:"committed_offset"`
+	Lag             int64 `json:"lag"`
+}
+
+// LagReport is one sample of the consumer group's lag. GrowthPerSecond is
+// the change in total lag since the previous sample.
+type LagReport struct {
+	Group           string         `json:"group"`
+	Topic           string         `json:"topic"`
+	Partitions      []PartitionLag `json:"partitions"`
+	TotalLag        int64          `json:"total_lag"`
+	GrowthPerSecond float64        `json:"growth_per_second"`
+	Degraded        bool           `json:"degraded"`
+	Reasons         []string       `json:"reasons,omitempty"`
+	CheckedAt       time.Time      `json:"checked_at"`
+}
+
+var (
+	lagMu     sync.RWMutex
+	latestLag *LagReport
+)
+
+// CurrentLag returns the latest lag sample, or nil before the first one.
+func CurrentLag() *LagReport {
+	lagMu.RLock()
+	defer lagMu.RUnlock()
+	return latestLag
+}
+
+// CheckLag reports an error while the latest sample is degraded, for the
+// readiness probe.
+func CheckLag(ctx context.Context) error {
+	report := CurrentLag()
+	if report == nil || !report.Degraded {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(report.Reasons, "; "))
+}
+
+// StartLagMonitor samples the group's committed lag every cfg.LagInterval
+// until ctx is cancelled. Lag is measured from committed offsets rather than
+// the reader's position, so it also covers partitions assigned to other
+// replicas and a group with no running consumers at all.
+func StartLagMonitor(ctx context.Context, cfg utils.Config) {
+	client := newClient(cfg)
+
+	ticker := time.NewTicker(cfg.LagInterval)
+	defer ticker.Stop()
+
+	for {
+		report, err := measureLag(ctx, client, cfg)
+		if err != nil {
+			slog.Error("Lag measurement failed", "error", err)
+		} else {
+			recordLag(cfg, report)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func measureLag(ctx context.Context, client *kafka.Client, cfg utils.Config) (*LagReport, error) {
+	partitions, err := topicPartitions(ctx, client, cfg.KafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	var offsetRequests []kafka.OffsetRequest
+	for _, p := range partitions {
+		offsetRequests = append(offsetRequests, kafka.FirstOffsetOf(p), kafka.LastOffsetOf(p))
+	}
+
+	offsets, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{cfg.KafkaTopic: offsetRequests},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offsets: %w", err)
+	}
+	committed, err := client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{
+		GroupID: cfg.ConsumerGroup,
+		Topics:  map[string][]int{cfg.KafkaTopic: partitions},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch committed offsets: %w", err)
+	}
+	if committed.Error != nil {
+		return nil, fmt.Errorf("failed to fetch committed offsets: %w", committed.Error)
+	}
+
+	committedBy := make(map[int]int64)
+	for _, p := range committed.Topics[cfg.KafkaTopic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("failed to fetch committed offset of partition %d: %w", p.Partition, p.Error)
+		}
+		committedBy[p.Partition] = p.CommittedOffset
+	}
+
+	report := &LagReport{Group: cfg.ConsumerGroup, Topic: cfg.KafkaTopic, CheckedAt: time.Now().UTC()}
+	for _, p := range offsets.Topics[cfg.KafkaTopic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("failed to list offsets of partition %d: %w", p.Partition, p.Error)
+		}
+		// A partition the group never committed to is read from where
+		// KAFKA_START_OFFSET points, so only "earliest" makes its retained
+		// history lag.
+		offset, ok := committedBy[p.Partition]
+		if !ok || offset < 0 {
+			offset = p.LastOffset
+			if cfg.KafkaStartOffset == ResetEarliest {
+				offset = p.FirstOffset
+			}
+		}
+		lag := p.LastOffset - offset
+		if lag < 0 {
+			lag = 0
+		}
+		report.Partitions = append(report.Partitions, PartitionLag{
+			Partition:       p.Partition,
+			HighWaterMark:   p.LastOffset,
+			CommittedOffset: offset,
+			Lag:             lag,
+		})
+		report.TotalLag += lag
+	}
+	sort.Slice(report.Partitions, func(i, j int) bool {
+		return report.Partitions[i].Partition < report.Partitions[j].Partition
+	})
+	return report, nil
+}
+
+// recordLag compares the sample with the previous one, applies the
+// thresholds and publishes it to the metrics and CurrentLag.
+func recordLag(cfg utils.Config, report *LagReport) {
+	lagMu.Lock()
+	defer lagMu.Unlock()
+
+	if prev := latestLag; prev != nil {
+		if elapsed := report.CheckedAt.Sub(prev.CheckedAt).Seconds(); elapsed > 0 {
+			report.GrowthPerSecond = float64(report.TotalLag-prev.TotalLag) / elapsed
+		}
+	}
+	if cfg.LagThreshold > 0 && report.TotalLag > cfg.LagThreshold {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("lag %d exceeds %d", report.TotalLag, cfg.LagThreshold))
+	}
+	if cfg.LagGrowthThreshold > 0 && report.GrowthPerSecond > cfg.LagGrowthThreshold {
+		report.Reasons = append(report.Reasons, fmt.Sprintf("lag growing %.1f/s, above %.1f/s", report.GrowthPerSecond, cfg.LagGrowthThreshold))
+	}
+	report.Degraded = len(report.Reasons) > 0
+
+	if report.Degraded && (latestLag == nil || !latestLag.Degraded) {
+		slog.Warn("Consumer lag degraded", "total_lag", report.TotalLag, "growth_per_second", report.GrowthPerSecond, "reasons", report.Reasons)
+	} else if !report.Degraded && latestLag != nil && latestLag.Degraded {
+		slog.Info("Consumer lag recovered", "total_lag", report.TotalLag)
+	}
+	latestLag = report
+
+	for _, p := range report.Partitions {
+		metrics.GroupLag.WithLabelValues(report.Topic, strconv.Itoa(p.Partition)).Set(float64(p.Lag))
+	}
+	metrics.GroupLagGrowth.Set(report.GrowthPerSecond)
+	if report.Degraded {
+		metrics.LagDegraded.Set(1)
+	} else {
+		metrics.LagDegraded.Set(0)
+	}
+}
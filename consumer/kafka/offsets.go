@@ -0,0 +1,176 @@
+package kafka
+
+import (
+	"consumer/utils"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	ResetEarliest  = "earliest"
+	ResetLatest    = "latest"
+	ResetTimestamp = "timestamp"
+	ResetOffsets   = "offsets"
+)
+
+// OffsetReset describes where to move the consumer group: the first or last
+// retained offset, the first offset at or after Time, or explicit Offsets
+// per partition. Partitions missing from Offsets keep their position.
+type OffsetReset struct {
+	To      string
+	Time    time.Time
+	Offsets map[int]int64
+}
+
+func newClient(cfg utils.Config) *kafka.Client {
+	return &kafka.Client{
+		Addr:    kafka.TCP(strings.Split(cfg.KafkaBroker, ",")...),
+		Timeout: 10 * time.Second,
+	}
+}
+
+func topicPartitions(ctx context.Context, client *kafka.Client, topic string) ([]int, error) {
+	meta, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{topic}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	if len(meta.Topics) == 0 {
+		return nil, fmt.Errorf("topic %s not found", topic)
+	}
+	if meta.Topics[0].Error != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", meta.Topics[0].Error)
+	}
+
+	partitions := make([]int, 0, len(meta.Topics[0].Partitions))
+	for _, p := range meta.Topics[0].Partitions {
+		partitions = append(partitions, p.ID)
+	}
+	sort.Ints(partitions)
+	return partitions, nil
+}
+
+// offsetsAt returns, per partition, the first offset whose message is at or
+// after t, or the high watermark when every message is older.
+func offsetsAt(ctx context.Context, client *kafka.Client, topic string, partitions []int, t time.Time) (map[int]int64, error) {
+	requests := make([]kafka.OffsetRequest, 0, 2*len(partitions))
+	for _, p := range partitions {
+		requests = append(requests, kafka.TimeOffsetOf(p, t), kafka.LastOffsetOf(p))
+	}
+	resp, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+		Topics: map[string][]kafka.OffsetRequest{topic: requests},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list offsets: %w", err)
+	}
+
+	offsets := make(map[int]int64, len(partitions))
+	for _, p := range resp.Topics[topic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("failed to list offsets of partition %d: %w", p.Partition, p.Error)
+		}
+		offset := p.LastOffset
+		for o := range p.Offsets {
+			if o >= 0 {
+				offset = o
+			}
+		}
+		offsets[p.Partition] = offset
+	}
+	return offsets, nil
+}
+
+// ResetGroupOffsets commits the offsets described by reset for the consumer
+// group and returns them. Kafka only accepts commits from outside the group
+// while it has no members, so every consumer replica must be stopped first.
+func ResetGroupOffsets(ctx context.Context, cfg utils.Config, reset OffsetReset) (map[int]int64, error) {
+	client := newClient(cfg)
+
+	groups, err := client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: []string{cfg.ConsumerGroup}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe group %s: %w", cfg.ConsumerGroup, err)
+	}
+	for _, g := range groups.Groups {
+		if g.Error != nil {
+			return nil, fmt.Errorf("failed to describe group %s: %w", cfg.ConsumerGroup, g.Error)
+		}
+		if len(g.Members) > 0 {
+			return nil, fmt.Errorf("group %s has %d active members; stop every consumer before resetting offsets", cfg.ConsumerGroup, len(g.Members))
+		}
+	}
+
+	partitions, err := topicPartitions(ctx, client, cfg.KafkaTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets map[int]int64
+	switch reset.To {
+	case ResetEarliest, ResetLatest:
+		requests := make([]kafka.OffsetRequest, len(partitions))
+		for i, p := range partitions {
+			if reset.To == ResetEarliest {
+				requests[i] = kafka.FirstOffsetOf(p)
+			} else {
+				requests[i] = kafka.LastOffsetOf(p)
+			}
+		}
+		resp, err := client.ListOffsets(ctx, &kafka.ListOffsetsRequest{
+			Topics: map[string][]kafka.OffsetRequest{cfg.KafkaTopic: requests},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list offsets: %w", err)
+		}
+		offsets = make(map[int]int64, len(partitions))
+		for _, p := range resp.Topics[cfg.KafkaTopic] {
+			if p.Error != nil {
+				return nil, fmt.Errorf("failed to list offsets of partition %d: %w", p.Partition, p.Error)
+			}
+			if reset.To == ResetEarliest {
+				offsets[p.Partition] = p.FirstOffset
+			} else {
+				offsets[p.Partition] = p.LastOffset
+			}
+		}
+	case ResetTimestamp:
+		if offsets, err = offsetsAt(ctx, client, cfg.KafkaTopic, partitions, reset.Time); err != nil {
+			return nil, err
+		}
+	case ResetOffsets:
+		known := make(map[int]bool, len(partitions))
+		for _, p := range partitions {
+			known[p] = true
+		}
+		for p, o := range reset.Offsets {
+			if !known[p] || o < 0 {
+				return nil, fmt.Errorf("invalid offset %d for partition %d", o, p)
+			}
+		}
+		offsets = reset.Offsets
+	default:
+		return nil, fmt.Errorf("unknown reset target %q", reset.To)
+	}
+
+	commits := make([]kafka.OffsetCommit, 0, len(offsets))
+	for p, o := range offsets {
+		commits = append(commits, kafka.OffsetCommit{Partition: p, Offset: o})
+	}
+	resp, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      cfg.ConsumerGroup,
+		GenerationID: -1,
+		Topics:       map[string][]kafka.OffsetCommit{cfg.KafkaTopic: commits},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit offsets: %w", err)
+	}
+	for _, p := range resp.Topics[cfg.KafkaTopic] {
+		if p.Error != nil {
+			return nil, fmt.Errorf("failed to commit offset of partition %d: %w", p.Partition, p.Error)
+		}
+	}
+	return offsets, nil
+}
@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"consumer/db"
+	"consumer/logging"
+	"consumer/services"
+	"consumer/utils"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// ReplayStats counts the messages a replay read and what became of them.
+type ReplayStats struct {
+	Read      int64 `json:"read"`
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+	Invalid   int64 `json:"invalid"`
+}
+
+func (s *ReplayStats) add(o ReplayStats) {
+	s.Read += o.Read
+	s.Processed += o.Processed
+	s.Failed += o.Failed
+	s.Invalid += o.Invalid
+}
+
+// Replay processes every message published to the topic in [from, to)
+// with ProcessClickEvent, reading each partition directly rather than
+// through the consumer group, so committed offsets are left alone. The end
+// of the range is fixed when the replay starts. mongoClient and redisClient
+// should point at a scratch namespace, and cfg.Replay be set.
+func Replay(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient, from, to time.Time) (ReplayStats, error) {
+	var total ReplayStats
+	if !from.Before(to) {
+		return total, fmt.Errorf("from must be before to")
+	}
+
+	client := newClient(cfg)
+	partitions, err := topicPartitions(ctx, client, cfg.KafkaTopic)
+	if err != nil {
+		return total, err
+	}
+	starts, err := offsetsAt(ctx, client, cfg.KafkaTopic, partitions, from)
+	if err != nil {
+		return total, err
+	}
+	ends, err := offsetsAt(ctx, client, cfg.KafkaTopic, partitions, to)
+	if err != nil {
+		return total, err
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, p := range partitions {
+		if starts[p] >= ends[p] {
+			continue
+		}
+		wg.Add(1)
+		go func(partition int, start, end int64) {
+			defer wg.Done()
+			stats, err := replayPartition(ctx, cfg, mongoClient, redisClient, partition, start, end)
+
+			mu.Lock()
+			defer mu.Unlock()
+			total.add(stats)
+			if err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("partition %d: %w", partition, err)
+			}
+		}(p, starts[p], ends[p])
+	}
+	wg.Wait()
+	return total, firstErr
+}
+
+func replayPartition(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient, partition int, start, end int64) (ReplayStats, error) {
+	var stats ReplayStats
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   strings.Split(cfg.KafkaBroker, ","),
+		Topic:     cfg.KafkaTopic,
+		Partition: partition,
+		MinBytes:  1,
+		MaxBytes:  10e6,
+		MaxWait:   500 * time.Millisecond,
+	})
+	defer reader.Close()
+	if err := reader.SetOffset(start); err != nil {
+		return stats, err
+	}
+
+	slog.Info("Replaying partition", "partition", partition, "from_offset", start, "to_offset", end)
+	for {
+		message, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return stats, err
+		}
+		if message.Offset >= end {
+			return stats, nil
+		}
+		stats.Read++
+
+		var event services.ClickEvent
+		if err := json.Unmarshal(message.Value, &event); err != nil {
+			stats.Invalid++
+		} else {
+			eventCtx := logging.WithCorrelationID(ctx, event.CorrelationID)
+			if err := services.ProcessClickEvent(eventCtx, event, cfg, mongoClient, redisClient); err != nil {
+				slog.ErrorContext(eventCtx, "Failed to replay event", "partition", partition, "offset", message.Offset, "error", err)
+				stats.Failed++
+			} else {
+				stats.Processed++
+			}
+		}
+
+		if message.Offset >= end-1 {
+			return stats, nil
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package logging configures structured JSON logging with log/slog. The level
+// can be changed at runtime, records carry the correlation and trace IDs
+// found in their context, and per-event logs are sampled.
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderRequestID carries the correlation ID on HTTP requests and responses.
+const HeaderRequestID = "X-Request-ID"
+
+var (
+	level  = new(slog.LevelVar)
+	events = slog.Default()
+)
+
+type correlationKey struct{}
+
+// Init installs a JSON handler on stdout as the default logger, which also
+// routes the standard log package through it. Records below warn on the
+// Events logger are kept one in sampleEvery.
+func Init(levelName string, sampleEvery int) {
+	if err := SetLevel(levelName); err != nil {
+		level.Set(slog.LevelInfo)
+	}
+
+	var handler slog.Handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	handler = contextHandler{handler}
+	slog.SetDefault(slog.New(handler))
+
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	events = slog.New(&samplingHandler{Handler: handler, every: uint64(sampleEvery), seen: new(atomic.Uint64)})
+}
+
+// Events returns the sampled logger for logs written once per event or
+// request.
+func Events() *slog.Logger {
+	return events
+}
+
+// SetLevel changes the minimum level of every logger.
+func SetLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// WithCorrelationID returns ctx carrying id, which is added to every record
+// logged with ctx.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, if any.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// contextHandler adds the correlation and trace IDs from the record's
+// context.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := CorrelationID(ctx); id != "" {
+		r.AddAttrs(slog.String("correlation_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// samplingHandler keeps one in every records below warn. Warnings and
+// errors always pass.
+type samplingHandler struct {
+	slog.Handler
+	every uint64
+	seen  *atomic.Uint64
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && h.seen.Add(1)%h.every != 0 {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithAttrs(attrs), every: h.every, seen: h.seen}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{Handler: h.Handler.WithGroup(name), every: h.every, seen: h.seen}
+}
+
+// Middleware assigns each request a correlation ID, reusing the caller's
+// X-Request-ID when present, echoes it on the response, stores it in the
+// request's user context and writes a sampled access log.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		id := c.Get(HeaderRequestID)
+		if id == "" {
+			id = uuid.NewString()
+		}
+		c.Set(HeaderRequestID, id)
+		c.SetUserContext(WithCorrelationID(c.UserContext(), id))
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+		events.InfoContext(c.UserContext(), "request",
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+		return err
+	}
+}
+
+// LevelHandler serves GET and PUT for the log level. PUT takes
+// {"level": "debug|info|warn|error"}.
+func LevelHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Method() == fiber.MethodPut {
+			var body struct {
+				Level string `json:"level"`
+			}
+			if err := c.BodyParser(&body); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+			}
+			if err := SetLevel(body.Level); err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "level must be debug, info, warn or error"})
+			}
+			slog.Warn("Log level changed", "level", level.Level().String())
+		}
+		return c.JSON(fiber.Map{"level": level.Level().String()})
+	}
+}
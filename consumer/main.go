@@ -1,18 +1,24 @@
 package main
 
 import (
+	"consumer/dashboard"
 	"consumer/db"
+	"consumer/handlers"
+	"consumer/health"
 	"consumer/kafka"
+	"consumer/logging"
+	"consumer/metrics"
 	"consumer/services"
+	"consumer/tracing"
 	"consumer/utils"
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 
 	// "net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,53 +26,143 @@ import (
 )
 
 func main() {
-	
-	log.Println("Starting Consumer Service...")
-	
 	cfg := utils.LoadConfig()
-	log.Printf("Config loaded: Kafka=%s, Topic=%s, Group=%s", 
-		cfg.KafkaBroker, cfg.KafkaTopic, cfg.ConsumerGroup)
+	logging.Init(cfg.LogLevel, cfg.LogSampleEvery)
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1], os.Args[2:]))
+	}
+
+	slog.Info("Starting Consumer Service",
+		"kafka", cfg.KafkaBroker, "topic", cfg.KafkaTopic, "group", cfg.ConsumerGroup)
+
+	shutdownTracing, err := tracing.Init(cfg.TraceExporter, cfg.TraceSampleRatio)
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
 
-	fmt.Println("congifff",cfg)
 	mongoClient, err := initializeMongoWithRetry(cfg, 5)
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB after retries: %v", err)
+		slog.Error("Failed to connect to MongoDB after retries", "error", err)
+		os.Exit(1)
 	}
-	defer mongoClient.Disconnect()
-	log.Println("Connected to MongoDB successfully")
+	slog.Info("Connected to MongoDB")
 
 	redisClient, err := initializeRedisWithRetry(cfg, 5)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis after retries: %v", err)
+		slog.Error("Failed to connect to Redis after retries", "error", err)
+		os.Exit(1)
 	}
-	defer redisClient.Close()
-	log.Println("Connected to Redis successfully")
+	slog.Info("Connected to Redis")
 
+	// signals is cancelled on SIGINT/SIGTERM; ctx outlives it until HTTP has
+	// drained, so requests still in flight can use Mongo and Redis.
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	ctx, cancel := context.WithCancel(context.Background())
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	// shutdownCtx bounds every shutdown step, the consumer's drain included.
+	// Its deadline is set once shutdown begins.
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
+	defer cancelShutdown()
 
+	services.EnsureQueryIndexes(mongoClient)
+
+	var jobs sync.WaitGroup
+	runJob := func(job func()) {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			job()
+		}()
+	}
+	runJob(func() { services.StartBudgetSync(ctx, mongoClient, redisClient, cfg.BudgetSyncInterval) })
+	runJob(func() { services.StartAttribution(ctx, cfg, mongoClient) })
+	runJob(func() { services.StartExperimentSync(ctx, mongoClient, cfg.ExperimentSyncInterval) })
+	runJob(func() { services.StartRollups(ctx, cfg, mongoClient, redisClient) })
+	runJob(func() { services.StartWindowing(ctx, cfg, mongoClient) })
+	runJob(func() { services.StartReports(ctx, cfg, mongoClient) })
+	runJob(func() { kafka.StartLagMonitor(ctx, cfg) })
+	runJob(func() { services.StartReconciliation(ctx, cfg, mongoClient, redisClient) })
+
+	consumerDone := make(chan error, 1)
+	go func() {
+		consumerDone <- kafka.StartConsumer(ctx, shutdownCtx, cfg, mongoClient, redisClient)
+	}()
+
+	app := newHTTPServer(ctx, cfg, mongoClient, redisClient, signals.Done())
+	serverDone := make(chan error, 1)
 	go func() {
-		<-sigChan
-		log.Println("Received shutdown signal, stopping consumer...")
-		defer cancel()
+		slog.Info("Fiber HTTP server running", "addr", ":8082")
+		serverDone <- app.Listen(":8082")
 	}()
 
-    go func() {
-        err := kafka.StartConsumer(ctx, cfg, mongoClient, redisClient)
-        if err != nil {
-            log.Fatalf("Kafka consumer failed: %v", err)
-        }
-    }()	
+	exitCode := 0
+	select {
+	case <-signals.Done():
+		slog.Info("Received shutdown signal, stopping consumer")
+	case err := <-serverDone:
+		slog.Error("Fiber server failed", "error", err)
+		exitCode = 1
+	case err := <-consumerDone:
+		slog.Error("Kafka consumer failed", "error", err)
+		consumerDone <- err
+		exitCode = 1
+	}
+	stop()
 
-	fmt.Println("@@@@@@@@@@@@@@@@@@@@@@")
-	startHTTPServer(ctx, mongoClient, redisClient)
+	// Shutdown runs in dependency order: stop accepting HTTP, stop reading
+	// Kafka and finish in-flight messages, then close the stores they write
+	// to. Every step shares one deadline.
+	time.AfterFunc(cfg.ShutdownTimeout, cancelShutdown)
 
-	// log.Println("Consumer service stopped")
+	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown failed", "error", err)
+	}
+	cancel()
+	select {
+	case <-consumerDone:
+		if err := services.FlushWindows(shutdownCtx, cfg, mongoClient); err != nil {
+			slog.Error("Failed to store open windows", "error", err)
+		}
+	case <-shutdownCtx.Done():
+		slog.Warn("Shutdown deadline passed before the Kafka consumer stopped")
+	}
+	if !waitGroup(shutdownCtx, &jobs) {
+		slog.Warn("Shutdown deadline passed before background jobs stopped")
+	}
+
+	mongoClient.Disconnect()
+	redisClient.Close()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Tracing shutdown failed", "error", err)
+	}
+	slog.Info("Consumer service stopped")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
+
+// waitGroup waits for wg until ctx is done and reports whether it finished.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
-func startHTTPServer(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient) {
+func newHTTPServer(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient, shutdown <-chan struct{}) *fiber.App {
 	app := fiber.New()
+	app.Use(metrics.Middleware())
+	app.Use(logging.Middleware())
 // 	mongoClient := &services.MongoClient{
 // 	Client:   actualMongoClient,
 // 	Database: actualMongoDatabase,
@@ -74,33 +170,38 @@ func startHTTPServer(ctx context.Context, mongoClient *db.MongoClient, redisClie
 
 	app.Get("/ads", func(c *fiber.Ctx) error {
 		const redisKey = "ads:all"
-		fmt.Println("@@@@@@@@@@@@@@@@@@")
 
+		var ads []map[string]interface{}
 		val, err := redisClient.Get(ctx, redisKey)
-		if err == nil && val != "" {
-			var ads []map[string]interface{}
-			if err := json.Unmarshal([]byte(val), &ads); err == nil {
-				return c.JSON(ads)
+		if err != nil || val == "" || json.Unmarshal([]byte(val), &ads) != nil {
+			ads, err = mongoClient.GetAllAds()
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch ads from DB"})
 			}
+
+			data, _ := json.Marshal(ads)
+			redisClient.Set(ctx, redisKey, data, time.Hour)
 		}
 
-		ads, err := mongoClient.GetAllAds()
+		userHash := services.HashUserID(cfg.UserHashSalt, c.Query("user_id"), c.IP(), c.Get(fiber.HeaderUserAgent))
+		ads, err = services.FilterFrequencyCapped(ctx, redisClient, cfg.FrequencyCaps, userHash, ads)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to apply frequency caps"})
+		}
+		ads, err = services.FilterBudgetExhausted(ctx, redisClient, ads)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch ads from DB"})
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to apply budgets"})
 		}
+		ads = services.ApplyExperiments(userHash, ads)
 
-		data, _ := json.Marshal(ads)
-		redisClient.Set(ctx, redisKey, data, time.Hour)
 		return c.JSON(ads)
 	})
 
 	app.Get("/ads/analytics", func(c *fiber.Ctx) error {
 		adID := c.Query("id")
 		window := c.Query("window", "1h")
-		fmt.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
 
 		dur, err := time.ParseDuration(window)
-		fmt.Println("timeeeee",dur)
 		if err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid window"})
 		}
@@ -115,10 +216,42 @@ func startHTTPServer(ctx context.Context, mongoClient *db.MongoClient, redisClie
 		return c.JSON(analytics)
 	})
 
-	log.Println("Fiber HTTP server running on :8081")
-	if err := app.Listen(":8082"); err != nil {
-		log.Fatalf("Fiber server failed: %v", err)
-	}
+	app.Get("/ads/analytics/series", handlers.GetAdSeries(mongoClient, redisClient))
+	app.Get("/ads/analytics/playback", handlers.GetPlayback(mongoClient, redisClient))
+	app.Get("/ads/live", handlers.LiveSSE(cfg, redisClient, shutdown))
+	app.Get("/ads/live/ws", handlers.RequireWebSocket, handlers.LiveWebSocket(cfg, redisClient, shutdown))
+	app.Get("/ads/top", handlers.GetTopAds(redisClient))
+	app.Get("/ads/conversions", handlers.GetConversions(mongoClient))
+	app.Get("/analytics/query", handlers.QueryAnalytics(mongoClient))
+	app.Post("/reports", handlers.CreateReport(mongoClient))
+	app.Post("/reports/schedules", handlers.SaveReportSchedule(mongoClient))
+	app.Get("/reports/schedules", handlers.ListReportSchedules(mongoClient))
+	app.Get("/reports/:id", handlers.GetReport(mongoClient))
+	app.Get("/reports/:id/download", handlers.DownloadReport(cfg, mongoClient))
+	app.Post("/budgets", handlers.SaveBudget(mongoClient))
+	app.Get("/budgets/:id", handlers.GetBudget(mongoClient, redisClient))
+	app.Post("/experiments", handlers.SaveExperiment(mongoClient))
+	app.Get("/experiments/:id", handlers.GetExperiment(mongoClient))
+	app.Get("/experiments/:id/assignment", handlers.GetAssignment(cfg, mongoClient))
+	app.Get("/experiments/:id/analytics", handlers.GetExperimentAnalytics(mongoClient, redisClient))
+
+	app.Use("/dashboard", dashboard.Handler())
+	app.Get("/metrics", metrics.Handler())
+	app.Get("/healthz", health.Live())
+	app.Get("/readyz", health.Ready(cfg.ReadyTimeout, map[string]health.Check{
+		"kafka":          func(ctx context.Context) error { return kafka.PingBroker(ctx, cfg) },
+		"consumer_group": func(ctx context.Context) error { return kafka.CheckGroupMembership(ctx, cfg) },
+		"mongo":          mongoClient.Ping,
+		"redis":          redisClient.Ping,
+		"consumer_lag":   func(ctx context.Context) error { return health.Degraded(kafka.CheckLag(ctx)) },
+	}))
+	app.Get("/admin/lag", handlers.GetConsumerLag())
+	app.Get("/admin/reconciliation", handlers.GetReconciliation(mongoClient))
+	app.Post("/admin/reconciliation", handlers.RunReconciliation(cfg, mongoClient, redisClient))
+	app.Get("/admin/log-level", logging.LevelHandler())
+	app.Put("/admin/log-level", logging.LevelHandler())
+
+	return app
 }
 
 func initializeMongoWithRetry(cfg utils.Config, maxRetries int) (*db.MongoClient, error) {
@@ -131,7 +264,7 @@ func initializeMongoWithRetry(cfg utils.Config, maxRetries int) (*db.MongoClient
 			return mongoClient, nil
 		}
 		
-		log.Printf("MongoDB connection attempt %d failed: %v", i+1, err)
+		slog.Warn("MongoDB connection attempt failed", "attempt", i+1, "error", err)
 		if i < maxRetries-1 {
 			time.Sleep(time.Duration(i+1) * 2 * time.Second)
 		}
@@ -150,7 +283,7 @@ func initializeRedisWithRetry(cfg utils.Config, maxRetries int) (*db.RedisClient
 			return redisClient, nil
 		}
 		
-		log.Printf("Redis connection attempt %d failed: %v", i+1, err)
+		slog.Warn("Redis connection attempt failed", "attempt", i+1, "error", err)
 		if i < maxRetries-1 {
 			time.Sleep(time.Duration(i+1) * 2 * time.Second)
 		}
@@ -0,0 +1,199 @@
+// Package metrics defines the consumer's Prometheus metrics and the hooks
+// and handlers that record and expose them.
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// MessagesConsumed counts Kafka messages by result: "processed",
+	// "failed" or "invalid" for messages that could not be decoded.
+	MessagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "consumer_messages_total",
+		Help: "Kafka messages consumed by result.",
+	}, []string{"result"})
+
+	ProcessingDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "consumer_processing_duration_seconds",
+		Help:    "Time to process one event through every sink.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// PartitionLag is the distance from the last fetched message to the
+	// partition's high watermark, as reported with each fetch.
+	PartitionLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_partition_lag",
+		Help: "Messages behind the high watermark per partition.",
+	}, []string{"topic", "partition"})
+
+	// GroupLag is the high watermark minus the group's committed offset per
+	// partition, sampled by the lag monitor for every replica's partitions.
+	GroupLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "consumer_group_lag",
+		Help: "Messages between the committed offset and the high watermark per partition.",
+	}, []string{"topic", "partition"})
+
+	GroupLagGrowth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_group_lag_growth_per_second",
+		Help: "Change in total committed lag per second between samples.",
+	})
+
+	LagDegraded = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_lag_degraded",
+		Help: "1 while lag or lag growth exceeds its configured threshold.",
+	})
+
+	// ReconcileDiscrepancies is the number of ad-hour counters the last
+	// reconciliation run found out of line with MongoDB, by metric.
+	ReconcileDiscrepancies = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reconcile_discrepancies",
+		Help: "Redis hourly counters differing from MongoDB in the last reconciliation run.",
+	}, []string{"metric"})
+
+	// ReconcileDrift is the summed absolute difference behind them.
+	ReconcileDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "reconcile_drift_events",
+		Help: "Absolute difference in events between Redis and MongoDB in the last reconciliation run.",
+	}, []string{"metric"})
+
+	ReconcileRepaired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "reconcile_repaired_total",
+		Help: "Redis hourly counters overwritten with the MongoDB count.",
+	})
+
+	ReconcileLastRun = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "reconcile_last_run_timestamp_seconds",
+		Help: "Unix time the last reconciliation run finished.",
+	})
+
+	// WorkersBusy is the number of messages being processed concurrently.
+	WorkersBusy = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "consumer_workers_busy",
+		Help: "Event processing goroutines currently running.",
+	})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "MongoDB command latency by command.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+
+	mongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_command_errors_total",
+		Help: "Failed MongoDB commands by command.",
+	}, []string{"command"})
+
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "redis_command_duration_seconds",
+		Help:    "Redis command latency by command; pipelines count as one.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"command"})
+
+	redisErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "redis_command_errors_total",
+		Help: "Failed Redis commands by command. Missing keys are not errors.",
+	}, []string{"command"})
+)
+
+// ObserveLag records the lag of partition after fetching offset.
+func ObserveLag(topic string, partition int, offset, highWaterMark int64) {
+	lag := highWaterMark - offset - 1
+	if lag < 0 {
+		lag = 0
+	}
+	PartitionLag.WithLabelValues(topic, strconv.Itoa(partition)).Set(float64(lag))
+}
+
+// MongoMonitor times every command the driver sends.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			mongoErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
+
+// RedisHook times every Redis command and pipeline.
+type RedisHook struct{}
+
+func (RedisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (RedisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		observeRedis(cmd.Name(), start, err)
+		return err
+	}
+}
+
+func (RedisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		observeRedis("pipeline", start, err)
+		return err
+	}
+}
+
+func observeRedis(command string, start time.Time, err error) {
+	redisDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	if err != nil && err != redis.Nil {
+		redisErrors.WithLabelValues(command).Inc()
+	}
+}
+
+// Middleware records the rate and latency of every request, labelled with
+// the matched route pattern rather than the raw path to bound cardinality.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+		route := c.Route().Path
+		method := c.Method()
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/logging"
+	"consumer/utils"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AttributionLastClick   = "last_click"
+	AttributionViewThrough = "view_through"
+	AttributionNone        = "none"
+
+	// attributionSettleDelay gives the click a conversion refers to time to
+	// be stored when both arrive in the same consumer batch.
+	attributionSettleDelay = 10 * time.Second
+	attributionBatchSize   = 500
+)
+
+type Conversion struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	ClickID     string             `bson:"click_id,omitempty" json:"click_id,omitempty"`
+	AdID        string             `bson:"ad_id,omitempty" json:"ad_id,omitempty"`
+	CampaignID  string             `bson:"campaign_id,omitempty" json:"campaign_id,omitempty"`
+	UserHash    string             `bson:"user_hash,omitempty" json:"-"`
+	Value       float64            `bson:"value" json:"value"`
+	Timestamp   time.Time          `bson:"timestamp" json:"timestamp"`
+	ProcessedAt time.Time          `bson:"processed_at" json:"processed_at"`
+	Attributed  bool               `bson:"attributed" json:"attributed"`
+	Attribution *Attribution       `bson:"attribution,omitempty" json:"attribution,omitempty"`
+}
+
+// Attribution records which touchpoint a conversion was credited to.
+type Attribution struct {
+	Model        string    `bson:"model" json:"model"`
+	AdID         string    `bson:"ad_id,omitempty" json:"ad_id,omitempty"`
+	CampaignID   string    `bson:"campaign_id,omitempty" json:"campaign_id,omitempty"`
+	ClickID      string    `bson:"click_id,omitempty" json:"click_id,omitempty"`
+	TouchTime    time.Time `bson:"touch_time,omitempty" json:"touch_time,omitempty"`
+	AttributedAt time.Time `bson:"attributed_at" json:"attributed_at"`
+}
+
+type ConversionReport struct {
+	AdID                    string    `json:"ad_id"`
+	Window                  string    `json:"window"`
+	Impressions             int64     `json:"impressions"`
+	Clicks                  int64     `json:"clicks"`
+	Conversions             int64     `json:"conversions"`
+	ClickThroughConversions int64     `json:"click_through_conversions"`
+	ViewThroughConversions  int64     `json:"view_through_conversions"`
+	ConversionValue         float64   `json:"conversion_value"`
+	ConversionRate          float64   `json:"conversion_rate_percentage"`
+	ViewThroughRate         float64   `json:"view_through_rate_percentage"`
+	Timestamp               time.Time `json:"timestamp"`
+}
+
+// clickFilter matches click documents, including those stored before events
+// carried an event_type.
+var clickFilter = bson.M{"$in": bson.A{EventClick, nil}}
+
+func storeConversion(ctx context.Context, event ClickEvent, mongoClient *db.MongoClient) error {
+	conversion := Conversion{
+		ClickID:     event.ClickID,
+		AdID:        event.AdID,
+		CampaignID:  event.CampaignID,
+		UserHash:    event.UserHash,
+		Value:       event.Value,
+		Timestamp:   event.Timestamp,
+		ProcessedAt: time.Now().UTC(),
+	}
+
+	result, err := mongoClient.Database.Collection("conversions").InsertOne(ctx, conversion)
+	if err != nil {
+		return fmt.Errorf("failed to insert conversion: %w", err)
+	}
+
+	logging.Events().DebugContext(ctx, "Stored conversion", "id", result.InsertedID)
+	return nil
+}
+
+// StartAttribution periodically credits unattributed conversions to the
+// click or impression that preceded them, until ctx is cancelled.
+func StartAttribution(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient) {
+	if err := ensureAttributionIndexes(ctx, mongoClient); err != nil {
+		slog.Error("Failed to create attribution indexes", "error", err)
+	}
+
+	ticker := time.NewTicker(cfg.AttributionInterval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := attributePending(ctx, cfg, mongoClient); err != nil {
+			slog.Error("Attribution run failed", "error", err)
+		} else if n > 0 {
+			slog.Info("Attributed conversions", "count", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func ensureAttributionIndexes(ctx context.Context, mongoClient *db.MongoClient) error {
+	_, err := mongoClient.Database.Collection("click_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "click_id", Value: 1}}},
+		{Keys: bson.D{{Key: "user_hash", Value: 1}, {Key: "event_type", Value: 1}, {Key: "timestamp", Value: -1}}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = mongoClient.Database.Collection("conversions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "attributed", Value: 1}, {Key: "processed_at", Value: 1}}},
+		{Keys: bson.D{{Key: "attribution.ad_id", Value: 1}, {Key: "timestamp", Value: 1}}},
+	})
+	return err
+}
+
+func attributePending(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient) (int, error) {
+	conversions := mongoClient.Database.Collection("conversions")
+
+	filter := bson.M{
+		"attributed":   false,
+		"processed_at": bson.M{"$lte": time.Now().UTC().Add(-attributionSettleDelay)},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "processed_at", Value: 1}}).SetLimit(attributionBatchSize)
+
+	cursor, err := conversions.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, err
+	}
+	var pending []Conversion
+	if err := cursor.All(ctx, &pending); err != nil {
+		return 0, err
+	}
+
+	for i, conversion := range pending {
+		attribution, err := attribute(ctx, cfg, mongoClient, conversion)
+		if err != nil {
+			return i, fmt.Errorf("failed to attribute conversion %s: %w", conversion.ID.Hex(), err)
+		}
+
+		update := bson.M{"$set": bson.M{"attributed": true, "attribution": attribution}}
+		if _, err := conversions.UpdateByID(ctx, conversion.ID, update); err != nil {
+			return i, fmt.Errorf("failed to update conversion %s: %w", conversion.ID.Hex(), err)
+		}
+	}
+	return len(pending), nil
+}
+
+// attribute applies last-click attribution within the click lookback,
+// preferring an explicit click_id, and falls back to view-through
+// attribution against the user's last impression.
+func attribute(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, conversion Conversion) (Attribution, error) {
+	events := mongoClient.Database.Collection("click_events")
+	latest := options.FindOne().SetSort(bson.D{{Key: "timestamp", Value: -1}})
+
+	window := func(lookback time.Duration) bson.M {
+		return bson.M{"$gte": conversion.Timestamp.Add(-lookback), "$lte": conversion.Timestamp}
+	}
+
+	var candidates []bson.M
+	if conversion.ClickID != "" {
+		candidates = append(candidates, bson.M{
+			"event_type": clickFilter,
+			"click_id":   conversion.ClickID,
+			"timestamp":  window(cfg.ClickLookback),
+		})
+	}
+	if conversion.UserHash != "" {
+		filter := bson.M{
+			"event_type": clickFilter,
+			"user_hash":  conversion.UserHash,
+			"timestamp":  window(cfg.ClickLookback),
+		}
+		if conversion.CampaignID != "" {
+			filter["campaign_id"] = conversion.CampaignID
+		}
+		candidates = append(candidates, filter)
+	}
+
+	for _, filter := range candidates {
+		var touch ClickEvent
+		err := events.FindOne(ctx, filter, latest).Decode(&touch)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return Attribution{}, err
+		}
+		return touchAttribution(AttributionLastClick, touch), nil
+	}
+
+	if conversion.UserHash != "" {
+		filter := bson.M{
+			"event_type": EventImpression,
+			"user_hash":  conversion.UserHash,
+			"timestamp":  window(cfg.ViewLookback),
+		}
+		if conversion.CampaignID != "" {
+			filter["campaign_id"] = conversion.CampaignID
+		}
+
+		var touch ClickEvent
+		err := events.FindOne(ctx, filter, latest).Decode(&touch)
+		if err == nil {
+			return touchAttribution(AttributionViewThrough, touch), nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return Attribution{}, err
+		}
+	}
+
+	return Attribution{Model: AttributionNone, AttributedAt: time.Now().UTC()}, nil
+}
+
+func touchAttribution(model string, touch ClickEvent) Attribution {
+	return Attribution{
+		Model:        model,
+		AdID:         touch.AdID,
+		CampaignID:   touch.CampaignID,
+		ClickID:      touch.ClickID,
+		TouchTime:    touch.Timestamp,
+		AttributedAt: time.Now().UTC(),
+	}
+}
+
+// GetConversionReport summarises attributed conversions for an ad over the
+// trailing window, read from Mongo.
+func GetConversionReport(mongoClient *db.MongoClient, adID string, timeWindow time.Duration) (*ConversionReport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now().UTC()
+	since := now.Add(-timeWindow)
+	report := &ConversionReport{AdID: adID, Window: timeWindow.String(), Timestamp: now}
+
+	events := mongoClient.Database.Collection("click_events")
+	clicks, err := events.CountDocuments(ctx, bson.M{
+		"ad_id":      adID,
+		"event_type": clickFilter,
+		"timestamp":  bson.M{"$gte": since},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count clicks: %w", err)
+	}
+	impressions, err := events.CountDocuments(ctx, bson.M{
+		"ad_id":      adID,
+		"event_type": EventImpression,
+		"timestamp":  bson.M{"$gte": since},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to count impressions: %w", err)
+	}
+	report.Clicks = clicks
+	report.Impressions = impressions
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"attribution.ad_id": adID,
+			"timestamp":         bson.M{"$gte": since},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   "$attribution.model",
+			"count": bson.M{"$sum": 1},
+			"value": bson.M{"$sum": "$value"},
+		}}},
+	}
+	cursor, err := mongoClient.Database.Collection("conversions").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate conversions: %w", err)
+	}
+	var groups []struct {
+		Model string  `bson:"_id"`
+		Count int64   `bson:"count"`
+		Value float64 `bson:"value"`
+	}
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, fmt.Errorf("failed to read conversions: %w", err)
+	}
+
+	for _, g := range groups {
+		switch g.Model {
+		case AttributionLastClick:
+			report.ClickThroughConversions = g.Count
+		case AttributionViewThrough:
+			report.ViewThroughConversions = g.Count
+		}
+		report.Conversions += g.Count
+		report.ConversionValue += g.Value
+	}
+
+	if report.Clicks > 0 {
+		report.ConversionRate = float64(report.ClickThroughConversions) / float64(report.Clicks) * 100
+	}
+	if report.Impressions > 0 {
+		report.ViewThroughRate = float64(report.ViewThroughConversions) / float64(report.Impressions) * 100
+	}
+	return report, nil
+}
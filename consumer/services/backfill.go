@@ -0,0 +1,211 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BackfillOptions selects the events a Redis backfill replays. Keys expire
+// at most a week after their last event, so From only needs to reach further
+// back for the totals of ads active without a day's gap since.
+type BackfillOptions struct {
+	From    time.Time
+	To      time.Time
+	AdIDs   []string
+	Workers int
+	DryRun  bool
+}
+
+// BackfillStats reports a backfill's progress. Fields are updated
+// atomically while it runs; read them with Snapshot.
+type BackfillStats struct {
+	Ads     int64 `json:"ads"`
+	AdsDone int64 `json:"ads_done"`
+	Events  int64 `json:"events"`
+	Keys    int64 `json:"keys"`
+	Expired int64 `json:"expired_keys"`
+}
+
+func (s *BackfillStats) Snapshot() BackfillStats {
+	return BackfillStats{
+		Ads:     atomic.LoadInt64(&s.Ads),
+		AdsDone: atomic.LoadInt64(&s.AdsDone),
+		Events:  atomic.LoadInt64(&s.Events),
+		Keys:    atomic.LoadInt64(&s.Keys),
+		Expired: atomic.LoadInt64(&s.Expired),
+	}
+}
+
+// backfillKey simulates one key of the plan as live processing would have
+// left it, taking each event's timestamp as the time it was processed.
+type backfillKey struct {
+	analyticsKey
+	count     int64
+	members   []redis.Z
+	expiresAt time.Time
+}
+
+func (k *backfillKey) apply(event ClickEvent) {
+	// The key expired between two events, so the next update starts over.
+	if !event.Timestamp.Before(k.expiresAt) {
+		k.count = 0
+		k.members = k.members[:0]
+	}
+	if k.Recent {
+		k.members = append(k.members, recentMember(event))
+	} else {
+		k.count++
+	}
+	k.expiresAt = event.Timestamp.Add(k.TTL)
+}
+
+// BackfillRedis rebuilds the keys updateRedisAnalytics maintains from
+// click_events, one ad per worker with events streamed in time order, and
+// overwrites the keys that would still be live with their expiry intact.
+// Events processed live while it runs may be overwritten, so the consumer
+// should be stopped. stats is updated as ads complete.
+func BackfillRedis(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient, opts BackfillOptions, stats *BackfillStats) error {
+	if !opts.From.Before(opts.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 1
+	}
+
+	adIDs := opts.AdIDs
+	if len(adIDs) == 0 {
+		ids, err := mongoClient.Database.Collection("click_events").Distinct(ctx, "ad_id", bson.M{
+			"timestamp": bson.M{"$gte": opts.From, "$lt": opts.To},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to list ads: %w", err)
+		}
+		for _, id := range ids {
+			if s, ok := id.(string); ok && s != "" {
+				adIDs = append(adIDs, s)
+			}
+		}
+	}
+	atomic.StoreInt64(&stats.Ads, int64(len(adIDs)))
+
+	jobs := make(chan string)
+	errs := make(chan error, opts.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for adID := range jobs {
+				if err := backfillAd(ctx, mongoClient, redisClient, adID, opts, stats); err != nil {
+					errs <- fmt.Errorf("ad %s: %w", adID, err)
+					return
+				}
+				atomic.AddInt64(&stats.AdsDone, 1)
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for _, adID := range adIDs {
+		select {
+		case jobs <- adID:
+		case err = <-errs:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errs:
+		default:
+		}
+	}
+	return err
+}
+
+func backfillAd(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient, adID string, opts BackfillOptions, stats *BackfillStats) error {
+	cursor, err := mongoClient.Database.Collection("click_events").Find(ctx,
+		bson.M{"ad_id": adID, "timestamp": bson.M{"$gte": opts.From, "$lt": opts.To}},
+		options.Find().
+			SetSort(bson.D{{Key: "timestamp", Value: 1}}).
+			SetProjection(bson.M{"event_type": 1, "ad_id": 1, "timestamp": 1, "ip": 1}).
+			SetBatchSize(1000))
+	if err != nil {
+		return fmt.Errorf("failed to read events: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	keys := make(map[string]*backfillKey)
+	var events int64
+	for cursor.Next(ctx) {
+		var event ClickEvent
+		if err := cursor.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode event: %w", err)
+		}
+		// Stored timestamps come back in UTC, and the key formats depend
+		// on the location, as they did when the consumer wrote them.
+		event.Timestamp = event.Timestamp.UTC()
+
+		for _, k := range analyticsKeys(event) {
+			state := keys[k.Key]
+			if state == nil {
+				state = &backfillKey{analyticsKey: k}
+				keys[k.Key] = state
+			}
+			state.apply(event)
+		}
+
+		events++
+		// Minute, hour and day keys are never touched again once the
+		// stream moves past them; drop those that expired to bound memory.
+		if events%10000 == 0 {
+			for key, state := range keys {
+				if !event.Timestamp.Before(state.expiresAt) {
+					delete(keys, key)
+				}
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to read events: %w", err)
+	}
+	atomic.AddInt64(&stats.Events, events)
+
+	now := time.Now()
+	pipe := redisClient.Client.Pipeline()
+	for _, state := range keys {
+		if !state.expiresAt.After(now) {
+			atomic.AddInt64(&stats.Expired, 1)
+			continue
+		}
+		atomic.AddInt64(&stats.Keys, 1)
+		if state.Recent {
+			pipe.Del(ctx, state.Key)
+			pipe.ZAdd(ctx, state.Key, state.members...)
+			pipe.PExpireAt(ctx, state.Key, state.expiresAt)
+		} else {
+			pipe.Set(ctx, state.Key, state.count, 0)
+			pipe.PExpireAt(ctx, state.Key, state.expiresAt)
+		}
+	}
+	if opts.DryRun || pipe.Len() == 0 {
+		return nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to write keys: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	PricingCPM  = "CPM"
+	PricingCPC  = "CPC"
+	PricingCPCV = "CPCV"
+
+	PacingEven = "even"
+	PacingASAP = "asap"
+
+	// Spend is tracked in millionths of the budget currency so Redis can
+	// update it with integer INCRBY.
+	microsPerUnit = 1_000_000
+)
+
+// Budget caps spend for a campaign, or for one line item when LineItemID is
+// set. Rate is the price of one billable unit: a thousand impressions for
+// CPM, a click for CPC and a completed view for CPCV.
+type Budget struct {
+	ID           string  `bson:"_id" json:"id"`
+	CampaignID   string  `bson:"campaign_id" json:"campaign_id"`
+	LineItemID   string  `bson:"line_item_id,omitempty" json:"line_item_id,omitempty"`
+	TotalBudget  float64 `bson:"total_budget" json:"total_budget"`
+	DailyBudget  float64 `bson:"daily_budget" json:"daily_budget"`
+	PricingModel string  `bson:"pricing_model" json:"pricing_model"`
+	Rate         float64 `bson:"rate" json:"rate"`
+	Pacing       string  `bson:"pacing" json:"pacing"`
+
+	TotalSpent   float64   `bson:"total_spent" json:"total_spent"`
+	DailySpent   float64   `bson:"daily_spent" json:"daily_spent"`
+	SpentDay     string    `bson:"spent_day,omitempty" json:"spent_day,omitempty"`
+	ReconciledAt time.Time `bson:"reconciled_at,omitempty" json:"reconciled_at,omitempty"`
+}
+
+// BudgetStatus is a budget together with its live spend from Redis.
+type BudgetStatus struct {
+	Budget
+	TotalRemaining float64 `json:"total_remaining"`
+	DailyRemaining float64 `json:"daily_remaining"`
+	DailyAllowed   float64 `json:"daily_allowed"`
+	Eligible       bool    `json:"eligible"`
+}
+
+// Validate normalises the pricing and pacing fields and rejects budgets
+// that cannot be enforced.
+func (b *Budget) Validate() error {
+	if b.CampaignID == "" {
+		return fmt.Errorf("campaign_id is required")
+	}
+	if b.ID == "" {
+		b.ID = b.CampaignID
+		if b.LineItemID != "" {
+			b.ID = b.CampaignID + ":" + b.LineItemID
+		}
+	}
+	switch b.PricingModel {
+	case PricingCPM, PricingCPC, PricingCPCV:
+	default:
+		return fmt.Errorf("pricing_model must be one of CPM, CPC, CPCV")
+	}
+	switch b.Pacing {
+	case "":
+		b.Pacing = PacingEven
+	case PacingEven, PacingASAP:
+	default:
+		return fmt.Errorf("pacing must be even or asap")
+	}
+	if b.Rate <= 0 || b.TotalBudget < 0 || b.DailyBudget < 0 {
+		return fmt.Errorf("rate must be positive and budgets non-negative")
+	}
+	return nil
+}
+
+// cost returns what the event is billed against this budget, in micros.
+func (b *Budget) cost(event ClickEvent) int64 {
+	var units float64
+	switch {
+	case b.PricingModel == PricingCPM && event.EventType == EventImpression:
+		units = b.Rate / 1000
+	case b.PricingModel == PricingCPC && event.EventType == EventClick:
+		units = b.Rate
+	case b.PricingModel == PricingCPCV && event.EventType == EventComplete:
+		units = b.Rate
+	}
+	return int64(math.Round(units * microsPerUnit))
+}
+
+func (b *Budget) matches(campaignID, lineItemID string) bool {
+	if b.CampaignID != campaignID {
+		return false
+	}
+	return b.LineItemID == "" || b.LineItemID == lineItemID
+}
+
+func spendTotalKey(budgetID string) string {
+	return fmt.Sprintf("spend:total:%s", budgetID)
+}
+
+func spendDayKey(budgetID string, day time.Time) string {
+	return fmt.Sprintf("spend:day:%s:%s", budgetID, day.UTC().Format("20060102"))
+}
+
+// budgetCache holds the budget definitions loaded from Mongo so the event
+// and serving paths never query Mongo per request.
+var budgetCache struct {
+	sync.RWMutex
+	budgets []Budget
+}
+
+func cachedBudgets(campaignID, lineItemID string) []Budget {
+	if campaignID == "" {
+		return nil
+	}
+
+	budgetCache.RLock()
+	defer budgetCache.RUnlock()
+
+	var matched []Budget
+	for _, b := range budgetCache.budgets {
+		if b.matches(campaignID, lineItemID) {
+			matched = append(matched, b)
+		}
+	}
+	return matched
+}
+
+// recordSpend charges a billable event against every matching budget. Both
+// spend counters are incremented in one MULTI so they never diverge.
+func recordSpend(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	pipe := redisClient.Client.TxPipeline()
+	queued := 0
+	for _, b := range cachedBudgets(event.CampaignID, event.LineItemID) {
+		micros := b.cost(event)
+		if micros == 0 {
+			continue
+		}
+		dayKey := spendDayKey(b.ID, event.Timestamp)
+		pipe.IncrBy(ctx, spendTotalKey(b.ID), micros)
+		pipe.IncrBy(ctx, dayKey, micros)
+		pipe.Expire(ctx, dayKey, 48*time.Hour)
+		queued++
+	}
+	if queued == 0 {
+		return nil
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record spend: %w", err)
+	}
+	return nil
+}
+
+// readSpend returns the total and today's spend of the given budgets.
+func readSpend(ctx context.Context, redisClient *db.RedisClient, budgets []Budget, now time.Time) ([]float64, []float64, error) {
+	if len(budgets) == 0 {
+		return nil, nil, nil
+	}
+
+	keys := make([]string, 0, 2*len(budgets))
+	for _, b := range budgets {
+		keys = append(keys, spendTotalKey(b.ID), spendDayKey(b.ID, now))
+	}
+	values, err := redisClient.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read spend: %w", err)
+	}
+
+	total := make([]float64, len(budgets))
+	daily := make([]float64, len(budgets))
+	for i := range budgets {
+		total[i] = microsToUnits(values[2*i])
+		daily[i] = microsToUnits(values[2*i+1])
+	}
+	return total, daily, nil
+}
+
+func microsToUnits(value interface{}) float64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	micros, _ := strconv.ParseInt(s, 10, 64)
+	return float64(micros) / microsPerUnit
+}
+
+// dailyAllowance is how much of the daily budget may be spent by now. Even
+// pacing spreads the budget linearly over the UTC day; ASAP allows all of it.
+func dailyAllowance(b Budget, now time.Time) float64 {
+	if b.Pacing != PacingEven {
+		return b.DailyBudget
+	}
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	elapsed := now.Sub(midnight).Seconds() / (24 * time.Hour).Seconds()
+	return b.DailyBudget * elapsed
+}
+
+func budgetStatus(b Budget, totalSpent, dailySpent float64, now time.Time) BudgetStatus {
+	status := BudgetStatus{Budget: b, Eligible: true}
+	status.TotalSpent = totalSpent
+	status.DailySpent = dailySpent
+	status.SpentDay = now.UTC().Format("20060102")
+	status.DailyAllowed = dailyAllowance(b, now)
+
+	if b.TotalBudget > 0 {
+		status.TotalRemaining = math.Max(b.TotalBudget-totalSpent, 0)
+		status.Eligible = status.Eligible && totalSpent < b.TotalBudget
+	}
+	if b.DailyBudget > 0 {
+		status.DailyRemaining = math.Max(b.DailyBudget-dailySpent, 0)
+		status.Eligible = status.Eligible && dailySpent < status.DailyAllowed
+	}
+	return status
+}
+
+// FilterBudgetExhausted drops ads whose campaign or line item has run out of
+// budget or is ahead of its pacing schedule.
+func FilterBudgetExhausted(ctx context.Context, redisClient *db.RedisClient, ads []map[string]interface{}) ([]map[string]interface{}, error) {
+	now := time.Now()
+
+	// Ads of one campaign share its budgets, so each budget's spend is read
+	// once, with a single MGET for the whole list.
+	adBudgets := make([][]Budget, len(ads))
+	seen := make(map[string]bool)
+	var budgets []Budget
+	for i, ad := range ads {
+		adBudgets[i] = cachedBudgets(AdField(ad, "campaign_id"), AdField(ad, "line_item_id"))
+		for _, b := range adBudgets[i] {
+			if !seen[b.ID] {
+				seen[b.ID] = true
+				budgets = append(budgets, b)
+			}
+		}
+	}
+	total, daily, err := readSpend(ctx, redisClient, budgets, now)
+	if err != nil {
+		return nil, err
+	}
+	exhausted := make(map[string]bool, len(budgets))
+	for i, b := range budgets {
+		exhausted[b.ID] = !budgetStatus(b, total[i], daily[i], now).Eligible
+	}
+
+	eligible := make([]map[string]interface{}, 0, len(ads))
+	for i, ad := range ads {
+		ok := true
+		for _, b := range adBudgets[i] {
+			if exhausted[b.ID] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			eligible = append(eligible, ad)
+		}
+	}
+	return eligible, nil
+}
+
+// GetBudgetStatus returns a budget definition with its live spend.
+func GetBudgetStatus(mongoClient *db.MongoClient, redisClient *db.RedisClient, budgetID string) (*BudgetStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var b Budget
+	if err := mongoClient.Database.Collection("budgets").FindOne(ctx, bson.M{"_id": budgetID}).Decode(&b); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	total, daily, err := readSpend(ctx, redisClient, []Budget{b}, now)
+	if err != nil {
+		return nil, err
+	}
+	status := budgetStatus(b, total[0], daily[0], now)
+	return &status, nil
+}
+
+// SaveBudget upserts a budget definition. Spend fields are owned by the
+// reconciler and are never overwritten here.
+func SaveBudget(mongoClient *db.MongoClient, b Budget) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	update := bson.M{"$set": bson.M{
+		"campaign_id":   b.CampaignID,
+		"line_item_id":  b.LineItemID,
+		"total_budget":  b.TotalBudget,
+		"daily_budget":  b.DailyBudget,
+		"pricing_model": b.PricingModel,
+		"rate":          b.Rate,
+		"pacing":        b.Pacing,
+	}}
+	_, err := mongoClient.Database.Collection("budgets").UpdateOne(ctx, bson.M{"_id": b.ID}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save budget: %w", err)
+	}
+	return nil
+}
+
+// StartBudgetSync keeps the in-memory budget cache fresh and periodically
+// reconciles the Redis spend counters into Mongo until ctx is cancelled.
+func StartBudgetSync(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		budgets, err := loadBudgets(ctx, mongoClient)
+		if err != nil {
+			slog.Error("Failed to load budgets", "error", err)
+		} else {
+			budgetCache.Lock()
+			budgetCache.budgets = budgets
+			budgetCache.Unlock()
+
+			// Seeding every time restores counters lost at runtime before
+			// reconcileSpend reads them.
+			seedSpend(ctx, redisClient, budgets)
+			if err := reconcileSpend(ctx, mongoClient, redisClient, budgets); err != nil {
+				slog.Error("Budget reconciliation failed", "error", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func loadBudgets(ctx context.Context, mongoClient *db.MongoClient) ([]Budget, error) {
+	cursor, err := mongoClient.Database.Collection("budgets").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var budgets []Budget
+	if err := cursor.All(ctx, &budgets); err != nil {
+		return nil, err
+	}
+	return budgets, nil
+}
+
+// seedSpend restores the total spend counters from Mongo when Redis has lost
+// them, so a flushed Redis does not hand out a fresh budget.
+func seedSpend(ctx context.Context, redisClient *db.RedisClient, budgets []Budget) {
+	today := time.Now().UTC().Format("20060102")
+	pipe := redisClient.Client.Pipeline()
+	for _, b := range budgets {
+		pipe.SetNX(ctx, spendTotalKey(b.ID), int64(math.Round(b.TotalSpent*microsPerUnit)), 0)
+		if b.SpentDay == today {
+			pipe.SetNX(ctx, spendDayKey(b.ID, time.Now()), int64(math.Round(b.DailySpent*microsPerUnit)), 48*time.Hour)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		slog.Error("Failed to seed spend counters", "error", err)
+	}
+}
+
+// reconcileSpend copies the Redis spend counters into Mongo. Spend only
+// grows, so a counter lost between seeding and reading never lowers the
+// stored total, or the daily spend within the same day.
+func reconcileSpend(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient, budgets []Budget) error {
+	now := time.Now()
+	today := now.UTC().Format("20060102")
+	total, daily, err := readSpend(ctx, redisClient, budgets, now)
+	if err != nil {
+		return err
+	}
+
+	collection := mongoClient.Database.Collection("budgets")
+	for i, b := range budgets {
+		set := bson.M{
+			"spent_day":     today,
+			"reconciled_at": now.UTC(),
+		}
+		grow := bson.M{"total_spent": total[i]}
+		if b.SpentDay == today {
+			grow["daily_spent"] = daily[i]
+		} else {
+			set["daily_spent"] = daily[i]
+		}
+		update := bson.M{"$set": set, "$max": grow}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": b.ID}, update); err != nil {
+			return fmt.Errorf("failed to reconcile budget %s: %w", b.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,385 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ExperimentRunning   = "running"
+	ExperimentPaused    = "paused"
+	ExperimentCompleted = "completed"
+
+	MetricCTR            = "ctr"
+	MetricCompletionRate = "completion_rate"
+)
+
+// ErrExperimentOverlap is returned when saving a running experiment whose
+// ads are already in another running experiment.
+var ErrExperimentOverlap = errors.New("ads already belong to running experiment")
+
+// Experiment splits traffic between ad variants. The first variant is the
+// control that every other variant is compared against.
+type Experiment struct {
+	ID            string    `bson:"_id" json:"id"`
+	Name          string    `bson:"name" json:"name"`
+	Status        string    `bson:"status" json:"status"`
+	PrimaryMetric string    `bson:"primary_metric" json:"primary_metric"`
+	Variants      []Variant `bson:"variants" json:"variants"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Variant is one arm of an experiment. Weight is relative to the other
+// variants, so weights 1/1 and 50/50 give the same split.
+type Variant struct {
+	ID     string `bson:"id" json:"id"`
+	AdID   string `bson:"ad_id" json:"ad_id"`
+	Weight int    `bson:"weight" json:"weight"`
+}
+
+type VariantStats struct {
+	VariantID      string  `json:"variant_id"`
+	AdID           string  `json:"ad_id"`
+	Impressions    int64   `json:"impressions"`
+	Clicks         int64   `json:"clicks"`
+	Completions    int64   `json:"completions"`
+	CTR            float64 `json:"ctr"`
+	CompletionRate float64 `json:"completion_rate"`
+}
+
+// Comparison is a variant measured against the control on one metric.
+// Lift and its interval are relative to the control rate.
+type Comparison struct {
+	VariantID   string  `json:"variant_id"`
+	Metric      string  `json:"metric"`
+	Control     float64 `json:"control_rate"`
+	Treatment   float64 `json:"variant_rate"`
+	Lift        float64 `json:"lift"`
+	LiftLower   float64 `json:"lift_ci_lower"`
+	LiftUpper   float64 `json:"lift_ci_upper"`
+	ZScore      float64 `json:"z_score"`
+	PValue      float64 `json:"p_value"`
+	Significant bool    `json:"significant"`
+}
+
+type ExperimentReport struct {
+	Experiment  Experiment     `json:"experiment"`
+	Confidence  float64        `json:"confidence"`
+	Variants    []VariantStats `json:"variants"`
+	Comparisons []Comparison   `json:"comparisons"`
+	Timestamp   time.Time      `json:"timestamp"`
+}
+
+// Validate fills defaults and rejects experiments that cannot be served.
+func (e *Experiment) Validate() error {
+	if e.ID == "" {
+		return fmt.Errorf("id is required")
+	}
+	if len(e.Variants) < 2 {
+		return fmt.Errorf("at least two variants are required")
+	}
+	switch e.PrimaryMetric {
+	case "":
+		e.PrimaryMetric = MetricCTR
+	case MetricCTR, MetricCompletionRate:
+	default:
+		return fmt.Errorf("primary_metric must be ctr or completion_rate")
+	}
+	switch e.Status {
+	case "":
+		e.Status = ExperimentRunning
+	case ExperimentRunning, ExperimentPaused, ExperimentCompleted:
+	default:
+		return fmt.Errorf("status must be running, paused or completed")
+	}
+
+	seen := make(map[string]bool)
+	seenAds := make(map[string]bool)
+	for _, v := range e.Variants {
+		if v.ID == "" || v.AdID == "" || v.Weight <= 0 {
+			return fmt.Errorf("every variant needs an id, ad_id and positive weight")
+		}
+		if seen[v.ID] {
+			return fmt.Errorf("duplicate variant id %q", v.ID)
+		}
+		// Variants are told apart by their ad's events, so they must not
+		// share one.
+		if seenAds[v.AdID] {
+			return fmt.Errorf("duplicate variant ad_id %q", v.AdID)
+		}
+		seen[v.ID] = true
+		seenAds[v.AdID] = true
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now().UTC()
+	}
+	return nil
+}
+
+// Assign deterministically maps a user onto a variant, so the same user
+// sees the same variant on every request and on every replica.
+func (e *Experiment) Assign(userHash string) Variant {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+
+	sum := sha256.Sum256([]byte(e.ID + ":" + userHash))
+	bucket := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v
+		}
+		bucket -= v.Weight
+	}
+	return e.Variants[len(e.Variants)-1]
+}
+
+func experimentKey(experimentID, variantID string) string {
+	return fmt.Sprintf("exp:%s:%s", experimentID, variantID)
+}
+
+var experimentCache struct {
+	sync.RWMutex
+	experiments []Experiment
+}
+
+func runningExperiments() []Experiment {
+	experimentCache.RLock()
+	defer experimentCache.RUnlock()
+
+	var running []Experiment
+	for _, e := range experimentCache.experiments {
+		if e.Status == ExperimentRunning {
+			running = append(running, e)
+		}
+	}
+	return running
+}
+
+// ApplyExperiments keeps only the assigned variant's ad for every running
+// experiment and tags it with experiment_id and variant_id, which the client
+// sends back with its events.
+func ApplyExperiments(userHash string, ads []map[string]interface{}) []map[string]interface{} {
+	experiments := runningExperiments()
+	if userHash == "" || len(experiments) == 0 {
+		return ads
+	}
+
+	type arm struct {
+		experimentID string
+		variantID    string
+		assigned     bool
+	}
+	arms := make(map[string]arm)
+	for _, e := range experiments {
+		assigned := e.Assign(userHash)
+		for _, v := range e.Variants {
+			arms[v.AdID] = arm{experimentID: e.ID, variantID: v.ID, assigned: v.ID == assigned.ID}
+		}
+	}
+
+	served := make([]map[string]interface{}, 0, len(ads))
+	for _, ad := range ads {
+		a, ok := arms[AdField(ad, "id")]
+		if !ok {
+			served = append(served, ad)
+			continue
+		}
+		if !a.assigned {
+			continue
+		}
+
+		tagged := make(map[string]interface{}, len(ad)+2)
+		for k, v := range ad {
+			tagged[k] = v
+		}
+		tagged["experiment_id"] = a.experimentID
+		tagged["variant_id"] = a.variantID
+		served = append(served, tagged)
+	}
+	return served
+}
+
+// recordExperimentEvent counts the event against its experiment variant.
+func recordExperimentEvent(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	if event.ExperimentID == "" || event.VariantID == "" {
+		return nil
+	}
+
+	key := experimentKey(event.ExperimentID, event.VariantID)
+	if err := redisClient.Client.HIncrBy(ctx, key, metricName(event.EventType), 1).Err(); err != nil {
+		return fmt.Errorf("failed to update experiment counters: %w", err)
+	}
+	return nil
+}
+
+// StartExperimentSync keeps the in-memory experiment cache fresh until ctx
+// is cancelled.
+func StartExperimentSync(ctx context.Context, mongoClient *db.MongoClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if experiments, err := loadExperiments(ctx, mongoClient); err != nil {
+			slog.Error("Failed to load experiments", "error", err)
+		} else {
+			experimentCache.Lock()
+			experimentCache.experiments = experiments
+			experimentCache.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func loadExperiments(ctx context.Context, mongoClient *db.MongoClient) ([]Experiment, error) {
+	cursor, err := mongoClient.Database.Collection("experiments").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var experiments []Experiment
+	if err := cursor.All(ctx, &experiments); err != nil {
+		return nil, err
+	}
+	return experiments, nil
+}
+
+func GetExperiment(mongoClient *db.MongoClient, experimentID string) (*Experiment, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var e Experiment
+	if err := mongoClient.Database.Collection("experiments").FindOne(ctx, bson.M{"_id": experimentID}).Decode(&e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func SaveExperiment(mongoClient *db.MongoClient, e Experiment) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// ApplyExperiments can serve each ad under one experiment only, so a
+	// running experiment may not share an ad with another.
+	if e.Status == ExperimentRunning {
+		adIDs := make([]string, len(e.Variants))
+		for i, v := range e.Variants {
+			adIDs[i] = v.AdID
+		}
+		var other Experiment
+		err := mongoClient.Database.Collection("experiments").FindOne(ctx, bson.M{
+			"_id":            bson.M{"$ne": e.ID},
+			"status":         ExperimentRunning,
+			"variants.ad_id": bson.M{"$in": adIDs},
+		}).Decode(&other)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrExperimentOverlap, other.ID)
+		}
+		if err != mongo.ErrNoDocuments {
+			return fmt.Errorf("failed to check running experiments: %w", err)
+		}
+	}
+
+	_, err := mongoClient.Database.Collection("experiments").ReplaceOne(ctx, bson.M{"_id": e.ID}, e, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save experiment: %w", err)
+	}
+	return nil
+}
+
+// GetExperimentReport compares every variant with the control on CTR and
+// completion rate using a two-proportion z-test at the given confidence.
+func GetExperimentReport(mongoClient *db.MongoClient, redisClient *db.RedisClient, experimentID string, confidence float64) (*ExperimentReport, error) {
+	e, err := GetExperiment(mongoClient, experimentID)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pipe := redisClient.Client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(e.Variants))
+	for i, v := range e.Variants {
+		cmds[i] = pipe.HGetAll(ctx, experimentKey(e.ID, v.ID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read experiment counters: %w", err)
+	}
+
+	report := &ExperimentReport{Experiment: *e, Confidence: confidence, Timestamp: time.Now().UTC()}
+	for i, v := range e.Variants {
+		counts := cmds[i].Val()
+		stats := VariantStats{VariantID: v.ID, AdID: v.AdID}
+		stats.Impressions, _ = strconv.ParseInt(counts["impressions"], 10, 64)
+		stats.Clicks, _ = strconv.ParseInt(counts["clicks"], 10, 64)
+		stats.Completions, _ = strconv.ParseInt(counts["completions"], 10, 64)
+		if stats.Impressions > 0 {
+			stats.CTR = float64(stats.Clicks) / float64(stats.Impressions)
+			stats.CompletionRate = float64(stats.Completions) / float64(stats.Impressions)
+		}
+		report.Variants = append(report.Variants, stats)
+	}
+
+	control := report.Variants[0]
+	for _, variant := range report.Variants[1:] {
+		report.Comparisons = append(report.Comparisons,
+			compareProportions(variant.VariantID, MetricCTR, control.Clicks, control.Impressions, variant.Clicks, variant.Impressions, confidence),
+			compareProportions(variant.VariantID, MetricCompletionRate, control.Completions, control.Impressions, variant.Completions, variant.Impressions, confidence),
+		)
+	}
+	return report, nil
+}
+
+// compareProportions runs a pooled two-proportion z-test and reports the
+// relative lift with an unpooled (Wald) confidence interval.
+func compareProportions(variantID, metric string, controlHits, controlN, variantHits, variantN int64, confidence float64) Comparison {
+	c := Comparison{VariantID: variantID, Metric: metric}
+	if controlN == 0 || variantN == 0 {
+		return c
+	}
+
+	pc := float64(controlHits) / float64(controlN)
+	pv := float64(variantHits) / float64(variantN)
+	c.Control, c.Treatment = pc, pv
+
+	pooled := float64(controlHits+variantHits) / float64(controlN+variantN)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(controlN) + 1/float64(variantN)))
+	if se > 0 {
+		c.ZScore = (pv - pc) / se
+		c.PValue = math.Erfc(math.Abs(c.ZScore) / math.Sqrt2)
+	} else {
+		c.PValue = 1
+	}
+	c.Significant = c.PValue < 1-confidence
+
+	if pc > 0 {
+		critical := math.Sqrt2 * math.Erfinv(confidence)
+		seDiff := math.Sqrt(pc*(1-pc)/float64(controlN) + pv*(1-pv)/float64(variantN))
+		c.Lift = (pv - pc) / pc
+		c.LiftLower = (pv - pc - critical*seDiff) / pc
+		c.LiftUpper = (pv - pc + critical*seDiff) / pc
+	}
+	return c
+}
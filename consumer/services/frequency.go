@@ -0,0 +1,136 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/utils"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// HashUserID derives the identifier used for per-user state. Raw user IDs
+// never reach Redis; when the client sent none, the IP and user agent pair
+// stands in for the user.
+func HashUserID(salt, userID, ip, userAgent string) string {
+	subject := "u:" + userID
+	if userID == "" {
+		if ip == "" {
+			return ""
+		}
+		subject = "ip:" + ip + "|" + userAgent
+	}
+
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(subject))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+func frequencyKey(userHash, scope, id string) string {
+	return fmt.Sprintf("freq:%s:%s:%s", userHash, scope, id)
+}
+
+// maxCapWindow is how long exposures must be retained to evaluate every cap.
+func maxCapWindow(caps []utils.FrequencyCap) time.Duration {
+	window := 24 * time.Hour
+	for _, c := range caps {
+		if c.Window > window {
+			window = c.Window
+		}
+	}
+	return window
+}
+
+// recordExposure appends an impression to the user's rolling exposure sets
+// for the ad and its campaign, trimming entries older than the widest cap.
+func recordExposure(ctx context.Context, event ClickEvent, userHash string, caps []utils.FrequencyCap, redisClient *db.RedisClient) error {
+	if event.EventType != EventImpression || userHash == "" {
+		return nil
+	}
+
+	window := maxCapWindow(caps)
+	member := fmt.Sprintf("%d-%s", event.Timestamp.UnixNano(), event.IP)
+	cutoff := strconv.FormatInt(time.Now().Add(-window).UnixMilli(), 10)
+
+	keys := []string{frequencyKey(userHash, "ad", event.AdID)}
+	if event.CampaignID != "" {
+		keys = append(keys, frequencyKey(userHash, "campaign", event.CampaignID))
+	}
+
+	pipe := redisClient.Client.Pipeline()
+	for _, key := range keys {
+		pipe.ZAdd(ctx, key, redis.Z{Score: float64(event.Timestamp.UnixMilli()), Member: member})
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+cutoff)
+		pipe.Expire(ctx, key, window)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record exposure: %w", err)
+	}
+	return nil
+}
+
+// FilterFrequencyCapped drops ads the user has already seen as often as any
+// configured cap allows.
+func FilterFrequencyCapped(ctx context.Context, redisClient *db.RedisClient, caps []utils.FrequencyCap, userHash string, ads []map[string]interface{}) ([]map[string]interface{}, error) {
+	if userHash == "" || len(caps) == 0 || len(ads) == 0 {
+		return ads, nil
+	}
+
+	now := time.Now()
+	pipe := redisClient.Client.Pipeline()
+	counts := make([][]*redis.IntCmd, len(ads))
+	for i, ad := range ads {
+		for _, c := range caps {
+			id := AdField(ad, "id")
+			if c.Scope == "campaign" {
+				id = AdField(ad, "campaign_id")
+			}
+			if id == "" {
+				counts[i] = append(counts[i], nil)
+				continue
+			}
+			min := strconv.FormatInt(now.Add(-c.Window).UnixMilli(), 10)
+			counts[i] = append(counts[i], pipe.ZCount(ctx, frequencyKey(userHash, c.Scope, id), min, "+inf"))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read exposure counts: %w", err)
+	}
+
+	eligible := make([]map[string]interface{}, 0, len(ads))
+	for i, ad := range ads {
+		capped := false
+		for j, c := range caps {
+			if cmd := counts[i][j]; cmd != nil && cmd.Val() >= int64(c.Limit) {
+				capped = true
+				break
+			}
+		}
+		if !capped {
+			eligible = append(eligible, ad)
+		}
+	}
+	return eligible, nil
+}
+
+// AdField reads a string attribute from an ad document. The ad ID falls back
+// to the Mongo _id when the document has no explicit "id".
+func AdField(ad map[string]interface{}, key string) string {
+	value, ok := ad[key]
+	if !ok && key == "id" {
+		value, ok = ad["_id"]
+	}
+	if !ok || value == nil {
+		return ""
+	}
+	if oid, isOID := value.(primitive.ObjectID); isOID {
+		return oid.Hex()
+	}
+	return fmt.Sprint(value)
+}
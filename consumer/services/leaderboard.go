@@ -0,0 +1,192 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	MetricClicks      = "clicks"
+	MetricImpressions = "impressions"
+	MetricCompletions = "completions"
+
+	leaderboardRetention = 8 * 24 * time.Hour
+	// MaxLeaderboardWindow is the longest window the hourly leaderboards
+	// can answer before they expire.
+	MaxLeaderboardWindow = 7 * 24 * time.Hour
+)
+
+type LeaderboardEntry struct {
+	Rank        int     `json:"rank"`
+	AdID        string  `json:"ad_id"`
+	Value       float64 `json:"value"`
+	Clicks      int64   `json:"clicks,omitempty"`
+	Impressions int64   `json:"impressions,omitempty"`
+}
+
+type Leaderboard struct {
+	Metric     string             `json:"metric"`
+	Window     string             `json:"window"`
+	CampaignID string             `json:"campaign_id,omitempty"`
+	Entries    []LeaderboardEntry `json:"entries"`
+	Timestamp  time.Time          `json:"timestamp"`
+}
+
+// ValidLeaderboardMetric reports whether metric has a leaderboard.
+func ValidLeaderboardMetric(metric string) bool {
+	switch metric {
+	case MetricClicks, MetricImpressions, MetricCompletions, MetricCTR:
+		return true
+	}
+	return false
+}
+
+// leaderboardKey names the sorted set of one metric for one hour, either
+// across all ads or within a single campaign.
+func leaderboardKey(metric, campaignID string, hour time.Time) string {
+	bucket := hour.UTC().Format(rollupHourLayout)
+	if campaignID == "" {
+		return fmt.Sprintf("top:%s:hour:%s", metric, bucket)
+	}
+	return fmt.Sprintf("top:%s:campaign:%s:hour:%s", metric, campaignID, bucket)
+}
+
+// recordLeaderboard scores the event's ad on the hourly leaderboards. CTR has
+// no leaderboard of its own; GetTopAds derives it from these counts.
+func recordLeaderboard(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	metric := metricName(event.EventType)
+	scopes := []string{""}
+	if event.CampaignID != "" {
+		scopes = append(scopes, event.CampaignID)
+	}
+
+	pipe := redisClient.Client.Pipeline()
+	for _, campaignID := range scopes {
+		key := leaderboardKey(metric, campaignID, event.Timestamp)
+		pipe.ZIncrBy(ctx, key, 1, event.AdID)
+		pipe.Expire(ctx, key, leaderboardRetention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update leaderboards: %w", err)
+	}
+	return nil
+}
+
+// leaderboardHours returns the hourly buckets covering the window, ending
+// with the current hour. The current hour is partial, so the window is
+// rounded up to whole hours and the hours before the current one cover it
+// in full: 1h reads the current and previous hour.
+func leaderboardHours(window time.Duration, now time.Time) []time.Time {
+	n := int((window+time.Hour-1)/time.Hour) + 1
+	current := now.UTC().Truncate(time.Hour)
+	hours := make([]time.Time, n)
+	for i := range hours {
+		hours[i] = current.Add(-time.Duration(i) * time.Hour)
+	}
+	return hours
+}
+
+// GetTopAds returns the best ads by metric over the trailing window. Counts
+// are summed across hourly leaderboards with ZUNIONSTORE; CTR is not
+// additive, so for multi-hour windows it is recomputed from the summed
+// clicks and impressions of ads with at least minImpressions.
+func GetTopAds(redisClient *db.RedisClient, metric string, window time.Duration, limit int, campaignID string, minImpressions int64) (*Leaderboard, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	board := &Leaderboard{Metric: metric, Window: window.String(), CampaignID: campaignID, Timestamp: time.Now().UTC()}
+	hours := leaderboardHours(window, time.Now())
+
+	if metric == MetricCTR {
+		entries, err := topByCTR(ctx, redisClient, hours, campaignID, limit, minImpressions)
+		if err != nil {
+			return nil, err
+		}
+		board.Entries = entries
+		return board, nil
+	}
+
+	scores, err := unionScores(ctx, redisClient, metric, campaignID, hours, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i, z := range scores {
+		board.Entries = append(board.Entries, LeaderboardEntry{Rank: i + 1, AdID: z.Member.(string), Value: z.Score})
+	}
+	return board, nil
+}
+
+// unionScores sums a metric's hourly leaderboards and returns the top limit
+// members, or all of them when limit is zero.
+func unionScores(ctx context.Context, redisClient *db.RedisClient, metric, campaignID string, hours []time.Time, limit int) ([]redis.Z, error) {
+	keys := make([]string, len(hours))
+	for i, h := range hours {
+		keys[i] = leaderboardKey(metric, campaignID, h)
+	}
+
+	stop := int64(limit - 1)
+	if len(keys) == 1 {
+		return redisClient.Client.ZRevRangeWithScores(ctx, keys[0], 0, stop).Result()
+	}
+
+	scratch := "top:tmp:" + uuid.NewString()
+	pipe := redisClient.Client.TxPipeline()
+	pipe.ZUnionStore(ctx, scratch, &redis.ZStore{Keys: keys, Aggregate: "SUM"})
+	pipe.Expire(ctx, scratch, time.Minute)
+	top := pipe.ZRevRangeWithScores(ctx, scratch, 0, stop)
+	pipe.Del(ctx, scratch)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to merge leaderboards: %w", err)
+	}
+	return top.Val(), nil
+}
+
+func topByCTR(ctx context.Context, redisClient *db.RedisClient, hours []time.Time, campaignID string, limit int, minImpressions int64) ([]LeaderboardEntry, error) {
+	impressions, err := unionScores(ctx, redisClient, MetricImpressions, campaignID, hours, 0)
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := unionScores(ctx, redisClient, MetricClicks, campaignID, hours, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	clicksByAd := make(map[string]float64, len(clicks))
+	for _, z := range clicks {
+		clicksByAd[z.Member.(string)] = z.Score
+	}
+
+	var entries []LeaderboardEntry
+	for _, z := range impressions {
+		if int64(z.Score) < minImpressions || z.Score == 0 {
+			continue
+		}
+		adID := z.Member.(string)
+		entries = append(entries, LeaderboardEntry{
+			AdID:        adID,
+			Value:       clicksByAd[adID] / z.Score * 100,
+			Clicks:      int64(clicksByAd[adID]),
+			Impressions: int64(z.Score),
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Value != entries[j].Value {
+			return entries[i].Value > entries[j].Value
+		}
+		return entries[i].Impressions > entries[j].Impressions
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+	return entries, nil
+}
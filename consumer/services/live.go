@@ -0,0 +1,216 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// liveStream keeps recent updates so reconnecting subscribers can
+	// resume from the last ID they saw. It is trimmed approximately.
+	liveStream       = "live:events"
+	liveStreamMaxLen = 100000
+	liveReplayLimit  = 1000
+
+	MaxLiveAds = 50
+)
+
+// LiveUpdate is one counter delta pushed to live subscribers. ID is the
+// entry ID in the live stream and orders updates across replicas.
+type LiveUpdate struct {
+	ID         string    `json:"id"`
+	AdID       string    `json:"ad_id"`
+	CampaignID string    `json:"campaign_id,omitempty"`
+	Metric     string    `json:"metric"`
+	Delta      int64     `json:"delta"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func liveChannel(adID string) string {
+	return "live:ad:" + adID
+}
+
+// publishLive appends the event's counter delta to the live stream and fans
+// it out on the ad's pub/sub channel, so subscribers on every replica see it.
+func publishLive(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	update := LiveUpdate{
+		AdID:       event.AdID,
+		CampaignID: event.CampaignID,
+		Metric:     metricName(event.EventType),
+		Delta:      1,
+		Timestamp:  event.Timestamp,
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	update.ID, err = redisClient.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: liveStream,
+		MaxLen: liveStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{"data": data},
+	}).Result()
+	if err != nil {
+		return fmt.Errorf("failed to append live update: %w", err)
+	}
+
+	data, err = json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	if err := redisClient.Client.Publish(ctx, liveChannel(event.AdID), data).Err(); err != nil {
+		return fmt.Errorf("failed to publish live update: %w", err)
+	}
+	return nil
+}
+
+// LiveSubscription streams updates for a set of ads. Replay holds the
+// updates missed since the Last-Event-ID the client resumed from.
+type LiveSubscription struct {
+	Replay  []LiveUpdate
+	Updates <-chan LiveUpdate
+
+	pubsub *redis.PubSub
+	cancel context.CancelFunc
+}
+
+// SubscribeLive subscribes to the ads' channels before reading the replay
+// from the live stream, so no update falls between the two; updates already
+// replayed are dropped from the live channel.
+func SubscribeLive(redisClient *db.RedisClient, adIDs []string, lastEventID string) (*LiveSubscription, error) {
+	if len(adIDs) == 0 {
+		return nil, fmt.Errorf("at least one ad id is required")
+	}
+	if len(adIDs) > MaxLiveAds {
+		return nil, fmt.Errorf("at most %d ad ids can be subscribed", MaxLiveAds)
+	}
+	if lastEventID != "" && !validStreamID(lastEventID) {
+		return nil, fmt.Errorf("invalid last event id %q", lastEventID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	channels := make([]string, len(adIDs))
+	wanted := make(map[string]bool, len(adIDs))
+	for i, id := range adIDs {
+		channels[i] = liveChannel(id)
+		wanted[id] = true
+	}
+
+	pubsub := redisClient.Client.Subscribe(ctx, channels...)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		cancel()
+		return nil, fmt.Errorf("failed to subscribe to live updates: %w", err)
+	}
+
+	sub := &LiveSubscription{pubsub: pubsub, cancel: cancel}
+	replayedTo := lastEventID
+	if lastEventID != "" {
+		replay, err := readLiveReplay(ctx, redisClient, wanted, lastEventID)
+		if err != nil {
+			sub.Close()
+			return nil, err
+		}
+		sub.Replay = replay
+		if len(replay) > 0 {
+			replayedTo = replay[len(replay)-1].ID
+		}
+	}
+
+	updates := make(chan LiveUpdate, 256)
+	sub.Updates = updates
+	go func() {
+		defer close(updates)
+		for msg := range pubsub.Channel() {
+			var update LiveUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				slog.Warn("Ignoring malformed live update", "error", err)
+				continue
+			}
+			if replayedTo != "" && !streamIDAfter(update.ID, replayedTo) {
+				continue
+			}
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// Close unsubscribes and stops the update channel.
+func (s *LiveSubscription) Close() {
+	s.cancel()
+	s.pubsub.Close()
+}
+
+// readLiveReplay returns up to liveReplayLimit updates for the wanted ads
+// after lastEventID, paging through the stream. Updates already trimmed
+// from the stream are lost.
+func readLiveReplay(ctx context.Context, redisClient *db.RedisClient, wanted map[string]bool, lastEventID string) ([]LiveUpdate, error) {
+	var replay []LiveUpdate
+	cursor := lastEventID
+	for {
+		entries, err := redisClient.Client.XRangeN(ctx, liveStream, "("+cursor, "+", liveReplayLimit).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read live replay: %w", err)
+		}
+
+		for _, entry := range entries {
+			cursor = entry.ID
+			data, _ := entry.Values["data"].(string)
+			var update LiveUpdate
+			if err := json.Unmarshal([]byte(data), &update); err != nil || !wanted[update.AdID] {
+				continue
+			}
+			update.ID = entry.ID
+			replay = append(replay, update)
+			if len(replay) == liveReplayLimit {
+				return replay, nil
+			}
+		}
+		if len(entries) < liveReplayLimit {
+			return replay, nil
+		}
+	}
+}
+
+func parseStreamID(id string) (ms, seq uint64, ok bool) {
+	parts := strings.SplitN(id, "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if len(parts) == 2 {
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return ms, seq, true
+}
+
+func validStreamID(id string) bool {
+	_, _, ok := parseStreamID(id)
+	return ok
+}
+
+// streamIDAfter reports whether stream entry ID a sorts after b.
+func streamIDAfter(a, b string) bool {
+	aMs, aSeq, _ := parseStreamID(a)
+	bMs, bSeq, _ := parseStreamID(b)
+	if aMs != bMs {
+		return aMs > bMs
+	}
+	return aSeq > bSeq
+}
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const playbackRetention = 8 * 24 * time.Hour
+
+// playbackBounds are the exclusive upper bounds, in seconds, of the playback
+// histogram buckets. A final bucket holds everything from the last bound
+// up. Changing them invalidates stored histograms.
+var playbackBounds = []int64{5, 10, 15, 20, 30, 45, 60, 90, 120, 180, 300, 600}
+
+// PlaybackHistogram counts watch times in the fixed playbackBounds buckets.
+// Histograms with the same bounds merge by adding, so hourly histograms
+// combine into any range.
+type PlaybackHistogram struct {
+	Count   int64   `bson:"count" json:"count"`
+	Sum     int64   `bson:"sum" json:"sum_seconds"`
+	Buckets []int64 `bson:"buckets" json:"buckets"`
+}
+
+type PlaybackBucket struct {
+	FromSeconds int64  `json:"from_seconds"`
+	ToSeconds   *int64 `json:"to_seconds,omitempty"`
+	Count       int64  `json:"count"`
+}
+
+// PlaybackStats summarises watch time for an ad over [From, To). Percentiles
+// are interpolated within histogram buckets.
+type PlaybackStats struct {
+	AdID          string           `json:"ad_id"`
+	From          time.Time        `json:"from"`
+	To            time.Time        `json:"to"`
+	Views         int64            `json:"views"`
+	TotalSeconds  int64            `json:"total_seconds"`
+	AvgSeconds    float64          `json:"avg_seconds"`
+	MedianSeconds float64          `json:"median_seconds"`
+	P90Seconds    float64          `json:"p90_seconds"`
+	Histogram     []PlaybackBucket `json:"histogram"`
+}
+
+func playbackBucket(seconds int64) int {
+	return sort.Search(len(playbackBounds), func(i int) bool { return playbackBounds[i] > seconds })
+}
+
+func (h *PlaybackHistogram) ensureBuckets() {
+	if len(h.Buckets) != len(playbackBounds)+1 {
+		buckets := make([]int64, len(playbackBounds)+1)
+		copy(buckets, h.Buckets)
+		h.Buckets = buckets
+	}
+}
+
+func (h *PlaybackHistogram) merge(o PlaybackHistogram) {
+	h.ensureBuckets()
+	h.Count += o.Count
+	h.Sum += o.Sum
+	for i, n := range o.Buckets {
+		if i < len(h.Buckets) {
+			h.Buckets[i] += n
+		}
+	}
+}
+
+// quantile interpolates linearly inside the bucket holding the q-th view.
+// The open-ended last bucket reports its lower bound.
+func (h *PlaybackHistogram) quantile(q float64) float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var seen float64
+	for i, n := range h.Buckets {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		lower := float64(0)
+		if i > 0 {
+			lower = float64(playbackBounds[i-1])
+		}
+		if i == len(playbackBounds) {
+			return lower
+		}
+		upper := float64(playbackBounds[i])
+		return lower + (upper-lower)*(rank-seen)/float64(n)
+	}
+	return float64(playbackBounds[len(playbackBounds)-1])
+}
+
+func playbackKey(adID string, hour time.Time) string {
+	return fmt.Sprintf("playback:hour:%s:%s", adID, hour.UTC().Format(rollupHourLayout))
+}
+
+// recordPlayback adds a click's watch time to the ad's hourly histogram.
+// Playback is taken from clicks only: each click is one view, while the
+// impression and complete pixels of a view carry no id to tell them apart
+// and would count it several times.
+func recordPlayback(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	if event.PlaybackSeconds <= 0 || event.EventType != EventClick {
+		return nil
+	}
+	seconds := int64(event.PlaybackSeconds)
+	key := playbackKey(event.AdID, event.Timestamp)
+
+	pipe := redisClient.Client.Pipeline()
+	pipe.HIncrBy(ctx, key, "count", 1)
+	pipe.HIncrBy(ctx, key, "sum", seconds)
+	pipe.HIncrBy(ctx, key, "b"+strconv.Itoa(playbackBucket(seconds)), 1)
+	pipe.Expire(ctx, key, playbackRetention)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update playback histogram: %w", err)
+	}
+	return nil
+}
+
+func parsePlaybackHash(fields map[string]string) PlaybackHistogram {
+	var h PlaybackHistogram
+	h.ensureBuckets()
+	h.Count, _ = strconv.ParseInt(fields["count"], 10, 64)
+	h.Sum, _ = strconv.ParseInt(fields["sum"], 10, 64)
+	for i := range h.Buckets {
+		h.Buckets[i], _ = strconv.ParseInt(fields["b"+strconv.Itoa(i)], 10, 64)
+	}
+	return h
+}
+
+// aggregatePlayback builds the histogram of an ad's hour from its stored
+// clicks, for the hourly rollup.
+func aggregatePlayback(ctx context.Context, mongoClient *db.MongoClient, adID string, hour time.Time) (PlaybackHistogram, error) {
+	boundaries := bson.A{int64(0)}
+	for _, b := range playbackBounds {
+		boundaries = append(boundaries, b)
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"ad_id":            adID,
+			"event_type":       clickFilter,
+			"timestamp":        bson.M{"$gte": hour, "$lt": hour.Add(time.Hour)},
+			"playback_seconds": bson.M{"$gt": 0},
+		}}},
+		{{Key: "$bucket", Value: bson.M{
+			"groupBy":    "$playback_seconds",
+			"boundaries": boundaries,
+			"default":    "overflow",
+			"output": bson.M{
+				"count": bson.M{"$sum": 1},
+				"sum":   bson.M{"$sum": "$playback_seconds"},
+			},
+		}}},
+	}
+
+	var h PlaybackHistogram
+	h.ensureBuckets()
+	cursor, err := mongoClient.Database.Collection("click_events").Aggregate(ctx, pipeline)
+	if err != nil {
+		return h, fmt.Errorf("failed to aggregate playback for %s: %w", adID, err)
+	}
+	var rows []bson.M
+	if err := cursor.All(ctx, &rows); err != nil {
+		return h, err
+	}
+
+	for _, row := range rows {
+		count := toInt64(row["count"])
+		// $bucket names each bucket by its lower boundary.
+		i := len(playbackBounds)
+		if _, overflow := row["_id"].(string); !overflow {
+			i = playbackBucket(toInt64(row["_id"]))
+		}
+		h.Buckets[i] += count
+		h.Count += count
+		h.Sum += toInt64(row["sum"])
+	}
+	return h, nil
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// GetPlaybackStats merges the hourly histograms covering [from, to). Hours
+// still inside the Redis retention are read from the live histograms, older
+// ones from the hourly rollups.
+func GetPlaybackStats(mongoClient *db.MongoClient, redisClient *db.RedisClient, adID string, from, to time.Time) (*PlaybackStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stats := &PlaybackStats{AdID: adID, From: from.UTC(), To: to.UTC()}
+	var total PlaybackHistogram
+	total.ensureBuckets()
+
+	redisFrom := time.Now().UTC().Add(-playbackRetention).Truncate(time.Hour).Add(time.Hour)
+	if from.Before(redisFrom) {
+		mongoTo := to
+		if redisFrom.Before(mongoTo) {
+			mongoTo = redisFrom
+		}
+		cursor, err := mongoClient.Database.Collection(hourlyRollups).Find(ctx, bson.M{
+			"ad_id":  adID,
+			"bucket": bson.M{"$gte": from.UTC().Truncate(time.Hour), "$lt": mongoTo},
+		}, options.Find().SetProjection(bson.M{"playback": 1}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read playback rollups: %w", err)
+		}
+		var rollups []Rollup
+		if err := cursor.All(ctx, &rollups); err != nil {
+			return nil, err
+		}
+		for _, r := range rollups {
+			total.merge(r.Playback)
+		}
+	}
+
+	var hours []time.Time
+	for _, h := range SeriesBuckets(from, to, GranularityHour) {
+		if !h.Before(redisFrom) {
+			hours = append(hours, h)
+		}
+	}
+	if len(hours) > 0 {
+		pipe := redisClient.Client.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(hours))
+		for i, h := range hours {
+			cmds[i] = pipe.HGetAll(ctx, playbackKey(adID, h))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, fmt.Errorf("failed to read playback histograms: %w", err)
+		}
+		for _, cmd := range cmds {
+			total.merge(parsePlaybackHash(cmd.Val()))
+		}
+	}
+
+	stats.Views = total.Count
+	stats.TotalSeconds = total.Sum
+	if total.Count > 0 {
+		stats.AvgSeconds = float64(total.Sum) / float64(total.Count)
+	}
+	stats.MedianSeconds = total.quantile(0.5)
+	stats.P90Seconds = total.quantile(0.9)
+	for i, n := range total.Buckets {
+		bucket := PlaybackBucket{Count: n}
+		if i > 0 {
+			bucket.FromSeconds = playbackBounds[i-1]
+		}
+		if i < len(playbackBounds) {
+			upper := playbackBounds[i]
+			bucket.ToSeconds = &upper
+		}
+		stats.Histogram = append(stats.Histogram, bucket)
+	}
+	return stats, nil
+}
@@ -2,22 +2,52 @@ package services
 
 import (
 	"consumer/db"
+	"consumer/logging"
+	"consumer/tracing"
+	"consumer/utils"
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 	"go.mongodb.org/mongo-driver/mongo"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
+const (
+	EventImpression = "impression"
+	EventClick      = "click"
+	EventComplete   = "complete"
+	EventConversion = "conversion"
+)
+
+// ClickEvent is the Kafka payload for every ad event. The bson tags match
+// the documents written by storeToMongoDB so stored events decode back.
 type ClickEvent struct {
-	AdID            string    `json:"ad_id"`
-	Timestamp       time.Time `json:"timestamp"`
-	IP              string    `json:"ip"`
-	PlaybackSeconds int       `json:"playback_seconds"`
-	UserAgent       string    `json:"user_agent,omitempty"`
+	EventType       string    `json:"event_type,omitempty" bson:"event_type"`
+	AdID            string    `json:"ad_id" bson:"ad_id"`
+	CampaignID      string    `json:"campaign_id,omitempty" bson:"campaign_id"`
+	LineItemID      string    `json:"line_item_id,omitempty" bson:"line_item_id"`
+	UserID          string    `json:"user_id,omitempty" bson:"-"`
+	ClickID         string    `json:"click_id,omitempty" bson:"click_id"`
+	ExperimentID    string    `json:"experiment_id,omitempty" bson:"experiment_id"`
+	VariantID       string    `json:"variant_id,omitempty" bson:"variant_id"`
+	Country         string    `json:"country,omitempty" bson:"country"`
+	Device          string    `json:"device,omitempty" bson:"device"`
+	Placement       string    `json:"placement,omitempty" bson:"placement"`
+	Publisher       string    `json:"publisher,omitempty" bson:"publisher"`
+	Timestamp       time.Time `json:"timestamp" bson:"timestamp"`
+	IP              string    `json:"ip" bson:"ip"`
+	PlaybackSeconds int       `json:"playback_seconds" bson:"playback_seconds"`
+	UserAgent       string    `json:"user_agent,omitempty" bson:"user_agent"`
+	Value           float64   `json:"value,omitempty" bson:"-"`
+	CorrelationID   string    `json:"correlation_id,omitempty" bson:"-"`
+
+	// UserHash is derived from UserID (or IP and user agent) by HashUserID
+	// and is the only user identifier that is persisted.
+	UserHash string `json:"-" bson:"user_hash"`
 }
 
 type MongoClient struct {
@@ -26,20 +56,78 @@ type MongoClient struct {
 }
 
 
-func ProcessClickEvent(event ClickEvent, mongoClient *db.MongoClient, redisClient *db.RedisClient) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// ProcessClickEvent writes the event to every sink. ctx carries the trace
+// continued from the Kafka message.
+func ProcessClickEvent(ctx context.Context, event ClickEvent, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	log.Printf("Processing click event for AdID: %s", event.AdID)
+	if event.EventType == "" {
+		event.EventType = EventClick
+	}
+	event.UserHash = HashUserID(cfg.UserHashSalt, event.UserID, event.IP, event.UserAgent)
+
+	if event.EventType == EventConversion {
+		return storeConversion(ctx, event, mongoClient)
+	}
+
+	logging.Events().DebugContext(ctx, "Processing event", "event_type", event.EventType, "ad_id", event.AdID)
 
 	if err := storeToMongoDB(ctx, event, mongoClient); err != nil {
-		log.Printf("MongoDB storage failed: %v", err)
+		slog.ErrorContext(ctx, "MongoDB storage failed", "error", err)
 
+	} else if err := markRollupDirty(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Rollup marker update failed", "error", err)
 	}
 
 
 	if err := updateRedisAnalytics(ctx, event, redisClient); err != nil {
-		log.Printf("Redis analytics update failed: %v", err)
+		slog.ErrorContext(ctx, "Redis analytics update failed", "error", err)
+		return err
+	}
+
+	if err := recordExposure(ctx, event, event.UserHash, cfg.FrequencyCaps, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Frequency counter update failed", "error", err)
+		return err
+	}
+
+	if err := recordReach(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Reach update failed", "error", err)
+		return err
+	}
+
+	if err := recordLeaderboard(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Leaderboard update failed", "error", err)
+		return err
+	}
+
+	if err := recordSpend(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Budget spend update failed", "error", err)
+		return err
+	}
+
+	if err := recordExperimentEvent(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Experiment counter update failed", "error", err)
+		return err
+	}
+
+	if err := recordPlayback(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Playback histogram update failed", "error", err)
+		return err
+	}
+
+	if err := recordWindowed(ctx, event, cfg, mongoClient); err != nil {
+		slog.ErrorContext(ctx, "Windowed aggregation failed", "error", err)
+		return err
+	}
+
+	// Live subscribers follow current traffic; Redis pub/sub is shared by
+	// every logical database, so replays must not publish.
+	if cfg.Replay {
+		return nil
+	}
+	if err := publishLive(ctx, event, redisClient); err != nil {
+		slog.ErrorContext(ctx, "Live update publish failed", "error", err)
 		return err
 	}
 
@@ -50,71 +138,118 @@ func storeToMongoDB(ctx context.Context, event ClickEvent, mongoClient *db.Mongo
 	collection := mongoClient.Database.Collection("click_events")
 	
 	document := map[string]interface{}{
-		"ad_id":             event.AdID,
-		"timestamp":         event.Timestamp,
-		"ip":                event.IP,
-		"playback_seconds":  event.PlaybackSeconds,
-		"user_agent":        event.UserAgent,
-		"processed_at":      time.Now().UTC(),
+		"event_type":       event.EventType,
+		"ad_id":            event.AdID,
+		"campaign_id":      event.CampaignID,
+		"line_item_id":     event.LineItemID,
+		"user_hash":        event.UserHash,
+		"click_id":         event.ClickID,
+		"experiment_id":    event.ExperimentID,
+		"variant_id":       event.VariantID,
+		"country":          event.Country,
+		"device":           event.Device,
+		"placement":        event.Placement,
+		"publisher":        event.Publisher,
+		"timestamp":        event.Timestamp,
+		"ip":               event.IP,
+		"playback_seconds": event.PlaybackSeconds,
+		"user_agent":       event.UserAgent,
+		"processed_at":     time.Now().UTC(),
 	}
 
+	ctx, span := tracing.StartClient(ctx, "mongo.insert click_events",
+		semconv.DBSystemMongoDB, semconv.DBCollectionName("click_events"))
 	result, err := collection.InsertOne(ctx, document)
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to insert into MongoDB: %w", err)
 	}
 
-	log.Printf("Stored click event in MongoDB with ID: %v", result.InsertedID)
+	logging.Events().DebugContext(ctx, "Stored click event", "id", result.InsertedID)
 	return nil
 }
 
-func updateRedisAnalytics(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
-	pipe := redisClient.Client.Pipeline()
+// metricName maps an event type onto the Redis counter family it increments.
+// Events without a type predate the pixel endpoint and are always clicks.
+func metricName(eventType string) string {
+	switch eventType {
+	case EventImpression:
+		return "impressions"
+	case EventComplete:
+		return "completions"
+	default:
+		return "clicks"
+	}
+}
+
+// analyticsKey is one Redis key updateRedisAnalytics maintains for an
+// event. Counters are incremented; recent keys are sorted sets holding one
+// member per event. Every update refreshes the key's TTL.
+type analyticsKey struct {
+	Key    string
+	TTL    time.Duration
+	Recent bool
+}
+
+// analyticsKeys is the key plan for an event, shared by the live update and
+// the backfill that rebuilds it from MongoDB.
+func analyticsKeys(event ClickEvent) []analyticsKey {
+	metric := metricName(event.EventType)
+	return []analyticsKey{
+		{Key: fmt.Sprintf("%s:total:%s", metric, event.AdID), TTL: 24 * time.Hour},
+		{Key: fmt.Sprintf("%s:minute:%s:%s", metric, event.AdID, event.Timestamp.Format("200601021504")), TTL: time.Hour}, // YYYYMMDDHHMM
+		{Key: analyticsHourKey(metric, event.AdID, event.Timestamp), TTL: analyticsHourTTL},
+		{Key: fmt.Sprintf("%s:day:%s:%s", metric, event.AdID, event.Timestamp.Format("20060102")), TTL: 7 * 24 * time.Hour}, // YYYYMMDD
+		{Key: fmt.Sprintf("%s:recent:%s", metric, event.AdID), TTL: time.Hour, Recent: true},
+	}
+}
+
+const analyticsHourTTL = 24 * time.Hour
+
+func analyticsHourKey(metric, adID string, t time.Time) string {
+	return fmt.Sprintf("%s:hour:%s:%s", metric, adID, t.Format(rollupHourLayout)) // YYYYMMDDHH
+}
 
-	totalClicksKey := fmt.Sprintf("clicks:total:%s", event.AdID)
-	pipe.Incr(ctx, totalClicksKey)
-	pipe.Expire(ctx, totalClicksKey, 24*time.Hour)
-	minuteKey := fmt.Sprintf("clicks:minute:%s:%s", 
-		event.AdID, 
-		event.Timestamp.Format("200601021504")) // YYYYMMDDHHMM
-	pipe.Incr(ctx, minuteKey)
-	pipe.Expire(ctx, minuteKey, 1*time.Hour) 
-	hourKey := fmt.Sprintf("clicks:hour:%s:%s", 
-		event.AdID, 
-		event.Timestamp.Format("2006010215")) // YYYYMMDDHH
-	pipe.Incr(ctx, hourKey)
-	pipe.Expire(ctx, hourKey, 24*time.Hour) // Keep for 24 hours
-
-	// 4. Track daily clicks
-	dayKey := fmt.Sprintf("clicks:day:%s:%s", 
-		event.AdID, 
-		event.Timestamp.Format("20060102")) // YYYYMMDD
-	pipe.Incr(ctx, dayKey)
-	pipe.Expire(ctx, dayKey, 7*24*time.Hour) // Keep for 7 days
-
-	// 5. Add to recent clicks sorted set
-	recentClicksKey := fmt.Sprintf("clicks:recent:%s", event.AdID)
-	pipe.ZAdd(ctx, recentClicksKey, redis.Z{
+// recentMember is the event's member in the recent sorted set.
+func recentMember(event ClickEvent) redis.Z {
+	return redis.Z{
 		Score:  float64(event.Timestamp.Unix()),
 		Member: fmt.Sprintf("%s-%d", event.IP, event.Timestamp.UnixNano()),
-	})
-	pipe.Expire(ctx, recentClicksKey, 1*time.Hour)
+	}
+}
+
+func updateRedisAnalytics(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	pipe := redisClient.Client.Pipeline()
+	for _, k := range analyticsKeys(event) {
+		if k.Recent {
+			pipe.ZAdd(ctx, k.Key, recentMember(event))
+		} else {
+			pipe.Incr(ctx, k.Key)
+		}
+		pipe.Expire(ctx, k.Key, k.TTL)
+	}
+	ctx, span := tracing.StartClient(ctx, "redis.pipeline analytics", semconv.DBSystemRedis)
 	_, err := pipe.Exec(ctx)
+	tracing.End(span, err)
 	if err != nil {
 		return fmt.Errorf("failed to update: %w", err)
 	}
 
-	log.Printf("Updated Redis analytics for AdID: %s", event.AdID)
+	logging.Events().DebugContext(ctx, "Updated Redis analytics", "metric", metricName(event.EventType), "ad_id", event.AdID)
 	return nil
 }
 
 
 
 type AdAnalytics struct {
-	AdID         string    `json:"ad_id"`
-	TotalClicks  int       `json:"total_clicks"`
-	RecentClicks int       `json:"recent_clicks"`
-	CTR          float64   `json:"ctr_percentage"`
-	Timestamp    time.Time `json:"timestamp"`
+	AdID              string     `json:"ad_id"`
+	TotalClicks       int        `json:"total_clicks"`
+	TotalImpressions  int        `json:"total_impressions"`
+	RecentClicks      int        `json:"recent_clicks"`
+	RecentImpressions int        `json:"recent_impressions"`
+	CTR               float64    `json:"ctr_percentage"`
+	Reach             ReachStats `json:"reach"`
+	Timestamp         time.Time  `json:"timestamp"`
 }
 
 func GetAdAnalytics(mongoClient *db.MongoClient,adID string, timeWindow time.Duration, redisClient *db.RedisClient) (*AdAnalytics, error) {
@@ -148,9 +283,29 @@ func GetAdAnalytics(mongoClient *db.MongoClient,adID string, timeWindow time.Dur
 		return nil, fmt.Errorf("failed to get recent clicks: %w", err)
 	}
 	analytics.RecentClicks = int(recentCount)
-	impressions := 1000
-	if impressions > 0 {
-		analytics.CTR = float64(analytics.TotalClicks) / float64(impressions) * 100
+
+	impressionsStr, err := redisClient.Client.Get(ctx, fmt.Sprintf("impressions:total:%s", adID)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get total impressions: %w", err)
+	}
+	if impressionsStr != "" {
+		analytics.TotalImpressions, _ = strconv.Atoi(impressionsStr)
+	}
+	if analytics.TotalImpressions > 0 {
+		analytics.CTR = float64(analytics.TotalClicks) / float64(analytics.TotalImpressions) * 100
+	}
+
+	recentImpressions, err := redisClient.Client.ZCount(ctx, fmt.Sprintf("impressions:recent:%s", adID),
+		strconv.FormatInt(fromTime.Unix(), 10),
+		strconv.FormatInt(now.Unix(), 10)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get recent impressions: %w", err)
+	}
+	analytics.RecentImpressions = int(recentImpressions)
+
+	analytics.Reach, err = GetReach(ctx, redisClient, adID, fromTime, now, recentImpressions)
+	if err != nil {
+		return nil, err
 	}
 
 	return analytics, nil
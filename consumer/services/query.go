@@ -0,0 +1,294 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	DimensionHourOfDay = "hour_of_day"
+
+	MaxQueryPageSize = 500
+	MaxQueryRange    = 92 * 24 * time.Hour
+)
+
+// queryDimensions maps each dimension callers may group or filter by onto
+// the click_events field holding it. hour_of_day is derived from timestamp
+// and can only be grouped by.
+var queryDimensions = map[string]string{
+	"ad_id":            "ad_id",
+	"campaign_id":      "campaign_id",
+	"line_item_id":     "line_item_id",
+	"country":          "country",
+	"device":           "device",
+	"placement":        "placement",
+	"publisher":        "publisher",
+	DimensionHourOfDay: "",
+}
+
+// rollupDimensions are the dimensions also stored on rollups_hourly.
+var rollupDimensions = map[string]bool{"ad_id": true, "campaign_id": true}
+
+// AnalyticsQuery is a grouped breakdown over [From, To).
+type AnalyticsQuery struct {
+	GroupBy  []string          `json:"group_by"`
+	Filters  map[string]string `json:"filters"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	SortBy   string            `json:"sort_by"`
+	Page     int               `json:"page"`
+	PageSize int               `json:"page_size"`
+}
+
+type QueryRow struct {
+	Dimensions     map[string]interface{} `json:"dimensions"`
+	Clicks         int64                  `json:"clicks"`
+	Impressions    int64                  `json:"impressions"`
+	Completions    int64                  `json:"completions"`
+	CTR            float64                `json:"ctr_percentage"`
+	CompletionRate float64                `json:"completion_rate_percentage"`
+}
+
+type QueryResult struct {
+	Query     AnalyticsQuery `json:"query"`
+	Source    string         `json:"source"`
+	TotalRows int64          `json:"total_rows"`
+	Rows      []QueryRow     `json:"rows"`
+}
+
+// IsQueryDimension reports whether name can be used in group_by.
+func IsQueryDimension(name string) bool {
+	_, ok := queryDimensions[name]
+	return ok
+}
+
+// IsQueryFilter reports whether name can be used as a filter.
+func IsQueryFilter(name string) bool {
+	return queryDimensions[name] != ""
+}
+
+// Validate fills defaults and rejects queries the store cannot answer
+// cheaply.
+func (q *AnalyticsQuery) Validate() error {
+	seen := make(map[string]bool, len(q.GroupBy))
+	for _, d := range q.GroupBy {
+		if !IsQueryDimension(d) {
+			return fmt.Errorf("unknown dimension %q", d)
+		}
+		if seen[d] {
+			return fmt.Errorf("duplicate dimension %q", d)
+		}
+		seen[d] = true
+	}
+	for f := range q.Filters {
+		if !IsQueryFilter(f) {
+			return fmt.Errorf("unknown filter %q", f)
+		}
+	}
+	if !q.From.Before(q.To) {
+		return fmt.Errorf("from must be before to")
+	}
+	if q.To.Sub(q.From) > MaxQueryRange {
+		return fmt.Errorf("range must not exceed %s", MaxQueryRange)
+	}
+
+	switch q.SortBy {
+	case "":
+		q.SortBy = MetricClicks
+	case MetricClicks, MetricImpressions, MetricCompletions:
+	default:
+		return fmt.Errorf("sort_by must be clicks, impressions or completions")
+	}
+	if q.Page <= 0 {
+		q.Page = 1
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = 50
+	}
+	if q.PageSize > MaxQueryPageSize {
+		return fmt.Errorf("page_size must not exceed %d", MaxQueryPageSize)
+	}
+	return nil
+}
+
+// usesRollups reports whether the hourly rollups can answer the query: it
+// only touches dimensions stored on them and the range is hour aligned.
+func (q *AnalyticsQuery) usesRollups() bool {
+	for _, d := range q.GroupBy {
+		if !rollupDimensions[d] {
+			return false
+		}
+	}
+	for f := range q.Filters {
+		if !rollupDimensions[f] {
+			return false
+		}
+	}
+	return q.From.Equal(q.From.Truncate(time.Hour)) && q.To.Equal(q.To.Truncate(time.Hour))
+}
+
+// EnsureQueryIndexes creates the click_events indexes the breakdown
+// pipelines filter on.
+func EnsureQueryIndexes(mongoClient *db.MongoClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	models := []mongo.IndexModel{{Keys: bson.D{{Key: "timestamp", Value: 1}}}}
+	for _, field := range []string{"campaign_id", "country", "device", "placement", "publisher"} {
+		models = append(models, mongo.IndexModel{Keys: bson.D{{Key: field, Value: 1}, {Key: "timestamp", Value: 1}}})
+	}
+	if _, err := mongoClient.Database.Collection("click_events").Indexes().CreateMany(ctx, models); err != nil {
+		slog.Error("Failed to create query indexes", "error", err)
+	}
+
+	_, err := mongoClient.Database.Collection(hourlyRollups).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "bucket", Value: 1}, {Key: "campaign_id", Value: 1}},
+	})
+	if err != nil {
+		slog.Error("Failed to create rollup query indexes", "error", err)
+	}
+}
+
+// RunAnalyticsQuery translates the query into an aggregation pipeline over
+// rollups_hourly when possible and click_events otherwise.
+func RunAnalyticsQuery(mongoClient *db.MongoClient, q AnalyticsQuery) (*QueryResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	collection, pipeline := queryPipeline(q)
+	result := &QueryResult{Query: q, Source: collection, Rows: []QueryRow{}}
+	pipeline = append(pipeline,
+		bson.D{{Key: "$facet", Value: bson.M{
+			"rows": bson.A{
+				bson.M{"$sort": querySort(q)},
+				bson.M{"$skip": (q.Page - 1) * q.PageSize},
+				bson.M{"$limit": q.PageSize},
+			},
+			"total": bson.A{bson.M{"$count": "n"}},
+		}}},
+	)
+
+	cursor, err := mongoClient.Database.Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run analytics query: %w", err)
+	}
+	var facets []struct {
+		Rows  []queryRowDoc `bson:"rows"`
+		Total []struct {
+			N int64 `bson:"n"`
+		} `bson:"total"`
+	}
+	if err := cursor.All(ctx, &facets); err != nil {
+		return nil, fmt.Errorf("failed to read analytics query: %w", err)
+	}
+	if len(facets) == 0 {
+		return result, nil
+	}
+
+	if len(facets[0].Total) > 0 {
+		result.TotalRows = facets[0].Total[0].N
+	}
+	for _, r := range facets[0].Rows {
+		result.Rows = append(result.Rows, r.row())
+	}
+	return result, nil
+}
+
+// queryPipeline returns the collection that answers the query and the
+// pipeline grouping it, before any sorting or paging.
+func queryPipeline(q AnalyticsQuery) (string, mongo.Pipeline) {
+	if q.usesRollups() {
+		return hourlyRollups, rollupQueryPipeline(q)
+	}
+	return "click_events", eventQueryPipeline(q)
+}
+
+// querySort orders groups by the sort metric, breaking ties by group so
+// every page of a query sees the same order.
+func querySort(q AnalyticsQuery) bson.D {
+	return bson.D{{Key: q.SortBy, Value: -1}, {Key: "_id", Value: 1}}
+}
+
+// queryRowDoc is one group as the pipelines return it.
+type queryRowDoc struct {
+	ID          bson.D `bson:"_id"`
+	Clicks      int64  `bson:"clicks"`
+	Impressions int64  `bson:"impressions"`
+	Completions int64  `bson:"completions"`
+}
+
+func (r queryRowDoc) row() QueryRow {
+	row := QueryRow{
+		Dimensions:  make(map[string]interface{}, len(r.ID)),
+		Clicks:      r.Clicks,
+		Impressions: r.Impressions,
+		Completions: r.Completions,
+	}
+	for _, e := range r.ID {
+		row.Dimensions[e.Key] = e.Value
+	}
+	if row.Impressions > 0 {
+		row.CTR = float64(row.Clicks) / float64(row.Impressions) * 100
+		row.CompletionRate = float64(row.Completions) / float64(row.Impressions) * 100
+	}
+	return row
+}
+
+func queryMatch(q AnalyticsQuery, timeField string) bson.M {
+	match := bson.M{timeField: bson.M{"$gte": q.From, "$lt": q.To}}
+	for f, v := range q.Filters {
+		match[queryDimensions[f]] = v
+	}
+	return match
+}
+
+// queryGroupID keys the groups by the GroupBy dimensions in order. The
+// result is sorted on _id to break ties, and embedded documents compare
+// field by field, so the order must be the same on every request.
+func queryGroupID(q AnalyticsQuery) bson.D {
+	id := bson.D{}
+	for _, d := range q.GroupBy {
+		if d == DimensionHourOfDay {
+			id = append(id, bson.E{Key: d, Value: bson.M{"$hour": "$timestamp"}})
+			continue
+		}
+		id = append(id, bson.E{Key: d, Value: "$" + queryDimensions[d]})
+	}
+	return id
+}
+
+func eventQueryPipeline(q AnalyticsQuery) mongo.Pipeline {
+	// Events stored before event_type existed are clicks.
+	eventType := bson.M{"$ifNull": bson.A{"$event_type", EventClick}}
+	countOf := func(t string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{eventType, t}}, 1, 0}}}
+	}
+
+	return mongo.Pipeline{
+		{{Key: "$match", Value: queryMatch(q, "timestamp")}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         queryGroupID(q),
+			"clicks":      countOf(EventClick),
+			"impressions": countOf(EventImpression),
+			"completions": countOf(EventComplete),
+		}}},
+	}
+}
+
+func rollupQueryPipeline(q AnalyticsQuery) mongo.Pipeline {
+	return mongo.Pipeline{
+		{{Key: "$match", Value: queryMatch(q, "bucket")}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         queryGroupID(q),
+			"clicks":      bson.M{"$sum": "$clicks"},
+			"impressions": bson.M{"$sum": "$impressions"},
+			"completions": bson.M{"$sum": "$completions"},
+		}}},
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	reachHourRetention = 8 * 24 * time.Hour
+	reachDayRetention  = 90 * 24 * time.Hour
+
+	// reachAll is the HyperLogLog family counting users across every event
+	// type, next to the per-metric families.
+	reachAll = "all"
+)
+
+// ReachStats are distinct-user counts estimated with HyperLogLog, so they
+// carry its ~0.8% standard error.
+type ReachStats struct {
+	UniqueUsers    int64   `json:"unique_users"`
+	UniqueViewers  int64   `json:"unique_viewers"`
+	UniqueClickers int64   `json:"unique_clickers"`
+	AvgFrequency   float64 `json:"avg_frequency"`
+}
+
+func reachKey(family, granularity, adID string, bucket time.Time) string {
+	layout := granularities[granularity].layout
+	return fmt.Sprintf("reach:%s:%s:%s:%s", family, granularity, adID, bucket.UTC().Format(layout))
+}
+
+// recordReach adds the event's user hash to the hourly and daily
+// HyperLogLogs of the ad, both for all events and for the event's metric.
+func recordReach(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	if event.UserHash == "" {
+		return nil
+	}
+
+	pipe := redisClient.Client.Pipeline()
+	for _, family := range []string{reachAll, metricName(event.EventType)} {
+		hourKey := reachKey(family, GranularityHour, event.AdID, event.Timestamp)
+		pipe.PFAdd(ctx, hourKey, event.UserHash)
+		pipe.Expire(ctx, hourKey, reachHourRetention)
+
+		dayKey := reachKey(family, GranularityDay, event.AdID, event.Timestamp)
+		pipe.PFAdd(ctx, dayKey, event.UserHash)
+		pipe.Expire(ctx, dayKey, reachDayRetention)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to update reach: %w", err)
+	}
+	return nil
+}
+
+// reachKeys covers [from, to) with as few HyperLogLogs as possible: daily
+// keys for whole UTC days and hourly keys for the partial days at the edges.
+func reachKeys(family, adID string, from, to time.Time) []string {
+	var keys []string
+	t := from.UTC().Truncate(time.Hour)
+	for t.Before(to) {
+		if t.Equal(t.Truncate(24*time.Hour)) && !t.Add(24*time.Hour).After(to) {
+			keys = append(keys, reachKey(family, GranularityDay, adID, t))
+			t = t.Add(24 * time.Hour)
+			continue
+		}
+		keys = append(keys, reachKey(family, GranularityHour, adID, t))
+		t = t.Add(time.Hour)
+	}
+	return keys
+}
+
+// countUnique merges the HyperLogLogs with PFMERGE into a short-lived
+// scratch key and returns its cardinality.
+func countUnique(ctx context.Context, redisClient *db.RedisClient, keys []string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if len(keys) == 1 {
+		return redisClient.Client.PFCount(ctx, keys[0]).Result()
+	}
+
+	scratch := "reach:tmp:" + uuid.NewString()
+	pipe := redisClient.Client.TxPipeline()
+	pipe.PFMerge(ctx, scratch, keys...)
+	pipe.Expire(ctx, scratch, time.Minute)
+	count := pipe.PFCount(ctx, scratch)
+	pipe.Del(ctx, scratch)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, fmt.Errorf("failed to merge reach: %w", err)
+	}
+	return count.Val(), nil
+}
+
+// GetReach estimates distinct users for an ad over [from, to). Hourly keys
+// are kept for 8 days and daily keys for 90, so older ranges undercount.
+// impressions is used to derive the average frequency per viewer.
+func GetReach(ctx context.Context, redisClient *db.RedisClient, adID string, from, to time.Time, impressions int64) (ReachStats, error) {
+	var stats ReachStats
+	var err error
+
+	if stats.UniqueUsers, err = countUnique(ctx, redisClient, reachKeys(reachAll, adID, from, to)); err != nil {
+		return stats, err
+	}
+	if stats.UniqueViewers, err = countUnique(ctx, redisClient, reachKeys("impressions", adID, from, to)); err != nil {
+		return stats, err
+	}
+	if stats.UniqueClickers, err = countUnique(ctx, redisClient, reachKeys("clicks", adID, from, to)); err != nil {
+		return stats, err
+	}
+
+	if stats.UniqueViewers > 0 {
+		stats.AvgFrequency = float64(impressions) / float64(stats.UniqueViewers)
+	}
+	return stats, nil
+}
@@ -0,0 +1,317 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/metrics"
+	"consumer/utils"
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	reconcileRuns = "reconciliation_runs"
+
+	// reconcileSettle keeps the hour that just ended out of a run until
+	// events still in the pipeline have landed in both stores.
+	reconcileSettle = 5 * time.Minute
+
+	// maxReportedDiscrepancies bounds the discrepancies stored with a run;
+	// the totals still count every one.
+	maxReportedDiscrepancies = 1000
+
+	reconcileReadBatch = 1000
+)
+
+var analyticsMetrics = []string{"clicks", "impressions", "completions"}
+
+// Discrepancy is an ad-hour counter whose Redis value differs from the
+// number of events MongoDB holds for it.
+type Discrepancy struct {
+	AdID     string    `bson:"ad_id" json:"ad_id"`
+	Metric   string    `bson:"metric" json:"metric"`
+	Hour     time.Time `bson:"hour" json:"hour"`
+	Redis    int64     `bson:"redis" json:"redis"`
+	Mongo    int64     `bson:"mongo" json:"mongo"`
+	Diff     int64     `bson:"diff" json:"diff"`
+	Repaired bool      `bson:"repaired" json:"repaired"`
+}
+
+// ReconcileRun is the outcome of comparing every hourly counter in
+// [From, To) with MongoDB.
+type ReconcileRun struct {
+	ID            string        `bson:"_id" json:"id"`
+	From          time.Time     `bson:"from" json:"from"`
+	To            time.Time     `bson:"to" json:"to"`
+	StartedAt     time.Time     `bson:"started_at" json:"started_at"`
+	FinishedAt    time.Time     `bson:"finished_at" json:"finished_at"`
+	Checked       int           `bson:"checked" json:"checked"`
+	Mismatched    int           `bson:"mismatched" json:"mismatched"`
+	Repaired      int           `bson:"repaired" json:"repaired"`
+	Repair        bool          `bson:"repair" json:"repair"`
+	Discrepancies []Discrepancy `bson:"discrepancies" json:"discrepancies"`
+}
+
+// StartReconciliation compares Redis hourly counters with MongoDB every
+// cfg.ReconcileInterval until ctx is cancelled, repairing Redis when
+// cfg.ReconcileRepair is set.
+func StartReconciliation(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) {
+	ticker := time.NewTicker(cfg.ReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		run, err := Reconcile(ctx, cfg, mongoClient, redisClient, cfg.ReconcileRepair)
+		if err != nil {
+			slog.Error("Reconciliation run failed", "error", err)
+		} else if run.Mismatched > 0 {
+			slog.Warn("Reconciliation found drifting counters", "checked", run.Checked, "mismatched", run.Mismatched, "repaired", run.Repaired)
+		}
+	}
+}
+
+// Reconcile runs one comparison over the complete hours in the lookback,
+// which stops short of the hour counters expire after, and stores the run.
+func Reconcile(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient, repair bool) (*ReconcileRun, error) {
+	now := time.Now().UTC()
+	lookback := cfg.ReconcileLookback
+	if lookback > analyticsHourTTL-time.Hour {
+		lookback = analyticsHourTTL - time.Hour
+	}
+	to := now.Add(-reconcileSettle).Truncate(time.Hour)
+	run := &ReconcileRun{
+		ID:        uuid.NewString(),
+		From:      to.Add(-lookback).Truncate(time.Hour),
+		To:        to,
+		StartedAt: now,
+		Repair:    repair,
+	}
+
+	truth, err := mongoHourlyCounts(ctx, mongoClient, run.From, run.To)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := redisHourlyCounts(ctx, redisClient, run.From, run.To)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]Discrepancy, len(truth))
+	for key, d := range truth {
+		keys[key] = d
+	}
+	for key, d := range counters {
+		if t, ok := keys[key]; ok {
+			t.Redis = d.Redis
+			keys[key] = t
+		} else {
+			keys[key] = d
+		}
+	}
+	run.Checked = len(keys)
+
+	var mismatched []Discrepancy
+	drift := make(map[string]int64)
+	count := make(map[string]int)
+	for key, d := range keys {
+		d.Diff = d.Redis - d.Mongo
+		if d.Diff == 0 {
+			continue
+		}
+		if repair {
+			if err := repairHourlyCounter(ctx, redisClient, key, d); err != nil {
+				slog.Error("Failed to repair counter", "key", key, "error", err)
+			} else {
+				d.Repaired = true
+				run.Repaired++
+				metrics.ReconcileRepaired.Inc()
+			}
+		}
+		mismatched = append(mismatched, d)
+		drift[d.Metric] += abs64(d.Diff)
+		count[d.Metric]++
+	}
+	run.Mismatched = len(mismatched)
+
+	sort.Slice(mismatched, func(i, j int) bool {
+		a, b := mismatched[i], mismatched[j]
+		if x, y := abs64(a.Diff), abs64(b.Diff); x != y {
+			return x > y
+		}
+		return a.Hour.Before(b.Hour)
+	})
+	if len(mismatched) > maxReportedDiscrepancies {
+		mismatched = mismatched[:maxReportedDiscrepancies]
+	}
+	run.Discrepancies = mismatched
+	run.FinishedAt = time.Now().UTC()
+
+	for _, metric := range analyticsMetrics {
+		metrics.ReconcileDiscrepancies.WithLabelValues(metric).Set(float64(count[metric]))
+		metrics.ReconcileDrift.WithLabelValues(metric).Set(float64(drift[metric]))
+	}
+	metrics.ReconcileLastRun.Set(float64(run.FinishedAt.Unix()))
+
+	if _, err := mongoClient.Database.Collection(reconcileRuns).InsertOne(ctx, run); err != nil {
+		return run, fmt.Errorf("failed to store reconciliation run: %w", err)
+	}
+	return run, nil
+}
+
+// LatestReconcileRun returns the most recent stored run, or nil if none has
+// finished yet.
+func LatestReconcileRun(mongoClient *db.MongoClient) (*ReconcileRun, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var run ReconcileRun
+	err := mongoClient.Database.Collection(reconcileRuns).FindOne(ctx, bson.M{},
+		options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}})).Decode(&run)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// mongoHourlyCounts counts events per ad, metric and hour, keyed by the
+// Redis hour key the consumer increments for them.
+func mongoHourlyCounts(ctx context.Context, mongoClient *db.MongoClient, from, to time.Time) (map[string]Discrepancy, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"ad_id":      "$ad_id",
+				"event_type": "$event_type",
+				"hour":       bson.M{"$dateTrunc": bson.M{"date": "$timestamp", "unit": "hour"}},
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+	cursor, err := mongoClient.Database.Collection("click_events").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count events: %w", err)
+	}
+	var rows []struct {
+		ID struct {
+			AdID      string    `bson:"ad_id"`
+			EventType string    `bson:"event_type"`
+			Hour      time.Time `bson:"hour"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]Discrepancy, len(rows))
+	for _, row := range rows {
+		metric := metricName(row.ID.EventType)
+		hour := row.ID.Hour.UTC()
+		key := analyticsHourKey(metric, row.ID.AdID, hour)
+		d := counts[key]
+		d.AdID, d.Metric, d.Hour = row.ID.AdID, metric, hour
+		d.Mongo += row.Count
+		counts[key] = d
+	}
+	return counts, nil
+}
+
+// redisHourlyCounts reads every analytics hour counter in [from, to),
+// including those for ads MongoDB has no events of, in one pass over the
+// keyspace.
+func redisHourlyCounts(ctx context.Context, redisClient *db.RedisClient, from, to time.Time) (map[string]Discrepancy, error) {
+	var keys []string
+	var parsed []Discrepancy
+	iter := redisClient.Client.Scan(ctx, 0, "*:hour:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		metric, rest, ok := strings.Cut(key, ":hour:")
+		if !ok || !isAnalyticsMetric(metric) {
+			continue
+		}
+		i := strings.LastIndex(rest, ":")
+		if i < 0 {
+			continue
+		}
+		hour, err := time.Parse(rollupHourLayout, rest[i+1:])
+		if err != nil || hour.Before(from) || !hour.Before(to) {
+			continue
+		}
+		keys = append(keys, key)
+		parsed = append(parsed, Discrepancy{AdID: rest[:i], Metric: metric, Hour: hour})
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan counters: %w", err)
+	}
+
+	counts := make(map[string]Discrepancy, len(keys))
+	for start := 0; start < len(keys); start += reconcileReadBatch {
+		end := start + reconcileReadBatch
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values, err := redisClient.Client.MGet(ctx, keys[start:end]...).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read counters: %w", err)
+		}
+		for i, v := range values {
+			s, ok := v.(string)
+			if !ok {
+				continue
+			}
+			d := parsed[start+i]
+			d.Redis, _ = strconv.ParseInt(s, 10, 64)
+			counts[keys[start+i]] = d
+		}
+	}
+	return counts, nil
+}
+
+func isAnalyticsMetric(metric string) bool {
+	for _, m := range analyticsMetrics {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+// repairHourlyCounter adds the drift to the counter rather than setting it,
+// so late events counted since it was read are kept. A counter recreated
+// by the repair expires when one last incremented within the hour would
+// have.
+func repairHourlyCounter(ctx context.Context, redisClient *db.RedisClient, key string, d Discrepancy) error {
+	expireAt := d.Hour.Add(time.Hour + analyticsHourTTL)
+	if !expireAt.After(time.Now()) {
+		return redisClient.Client.Del(ctx, key).Err()
+	}
+	pipe := redisClient.Client.TxPipeline()
+	pipe.IncrBy(ctx, key, -d.Diff)
+	pipe.ExpireNX(ctx, key, time.Until(expireAt))
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func abs64(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
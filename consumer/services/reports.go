@@ -0,0 +1,487 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/utils"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ReportCSV     = "csv"
+	ReportParquet = "parquet"
+
+	ReportQueued    = "queued"
+	ReportRunning   = "running"
+	ReportSucceeded = "succeeded"
+	ReportFailed    = "failed"
+
+	ScheduleDaily  = "daily"
+	ScheduleWeekly = "weekly"
+
+	// reportJobTimeout is how long a job may stay running before it is
+	// taken to have died with its worker and is claimed again.
+	reportJobTimeout = 30 * time.Minute
+)
+
+// reportMetrics are the value columns written after the dimension columns.
+var reportMetrics = []string{"clicks", "impressions", "completions", "ctr_percentage", "completion_rate_percentage"}
+
+// ReportJob runs an analytics query to completion and writes every row to a
+// file in the report directory.
+type ReportJob struct {
+	ID         string         `bson:"_id" json:"id"`
+	Query      AnalyticsQuery `bson:"query" json:"query"`
+	Format     string         `bson:"format" json:"format"`
+	Status     string         `bson:"status" json:"status"`
+	Error      string         `bson:"error,omitempty" json:"error,omitempty"`
+	File       string         `bson:"file,omitempty" json:"file,omitempty"`
+	Rows       int64          `bson:"rows" json:"rows"`
+	ScheduleID string         `bson:"schedule_id,omitempty" json:"schedule_id,omitempty"`
+	CreatedAt  time.Time      `bson:"created_at" json:"created_at"`
+	StartedAt  time.Time      `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt time.Time      `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// ReportSchedule creates a report job for a campaign every day or week,
+// covering the period that just ended.
+type ReportSchedule struct {
+	ID         string    `bson:"_id" json:"id"`
+	CampaignID string    `bson:"campaign_id" json:"campaign_id"`
+	Frequency  string    `bson:"frequency" json:"frequency"`
+	Format     string    `bson:"format" json:"format"`
+	GroupBy    []string  `bson:"group_by" json:"group_by"`
+	NextRunAt  time.Time `bson:"next_run_at" json:"next_run_at"`
+	LastRunAt  time.Time `bson:"last_run_at,omitempty" json:"last_run_at,omitempty"`
+}
+
+func validReportFormat(format string) bool {
+	return format == ReportCSV || format == ReportParquet
+}
+
+func (s *ReportSchedule) period() time.Duration {
+	if s.Frequency == ScheduleWeekly {
+		return 7 * 24 * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// Validate fills defaults and schedules the first run for the next UTC
+// midnight.
+func (s *ReportSchedule) Validate() error {
+	if s.CampaignID == "" {
+		return fmt.Errorf("campaign_id is required")
+	}
+	if s.Frequency != ScheduleDaily && s.Frequency != ScheduleWeekly {
+		return fmt.Errorf("frequency must be daily or weekly")
+	}
+	if s.Format == "" {
+		s.Format = ReportCSV
+	}
+	if !validReportFormat(s.Format) {
+		return fmt.Errorf("format must be csv or parquet")
+	}
+	for _, d := range s.GroupBy {
+		if !IsQueryDimension(d) {
+			return fmt.Errorf("unknown dimension %q", d)
+		}
+	}
+	if s.ID == "" {
+		s.ID = uuid.NewString()
+	}
+	if s.NextRunAt.IsZero() {
+		s.NextRunAt = time.Now().UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+	}
+	return nil
+}
+
+// ValidateReportJob fills the query's defaults and rejects jobs the worker
+// cannot run.
+func ValidateReportJob(query *AnalyticsQuery, format string) error {
+	if !validReportFormat(format) {
+		return fmt.Errorf("format must be csv or parquet")
+	}
+	return query.Validate()
+}
+
+// CreateReportJob validates the query and queues a job for the worker.
+func CreateReportJob(mongoClient *db.MongoClient, query AnalyticsQuery, format, scheduleID string) (*ReportJob, error) {
+	if err := ValidateReportJob(&query, format); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	job := &ReportJob{
+		ID:         uuid.NewString(),
+		Query:      query,
+		Format:     format,
+		Status:     ReportQueued,
+		ScheduleID: scheduleID,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if _, err := mongoClient.Database.Collection("report_jobs").InsertOne(ctx, job); err != nil {
+		return nil, fmt.Errorf("failed to queue report job: %w", err)
+	}
+	return job, nil
+}
+
+func GetReportJob(mongoClient *db.MongoClient, jobID string) (*ReportJob, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var job ReportJob
+	if err := mongoClient.Database.Collection("report_jobs").FindOne(ctx, bson.M{"_id": jobID}).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ReportPath returns where a finished job's file lives on disk.
+func ReportPath(cfg utils.Config, job *ReportJob) string {
+	return filepath.Join(cfg.ReportDir, job.File)
+}
+
+func SaveReportSchedule(mongoClient *db.MongoClient, s ReportSchedule) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := mongoClient.Database.Collection("report_schedules").ReplaceOne(ctx, bson.M{"_id": s.ID}, s, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save report schedule: %w", err)
+	}
+	return nil
+}
+
+func ListReportSchedules(mongoClient *db.MongoClient, campaignID string) ([]ReportSchedule, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	filter := bson.M{}
+	if campaignID != "" {
+		filter["campaign_id"] = campaignID
+	}
+	cursor, err := mongoClient.Database.Collection("report_schedules").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	schedules := []ReportSchedule{}
+	if err := cursor.All(ctx, &schedules); err != nil {
+		return nil, err
+	}
+	return schedules, nil
+}
+
+// StartReports runs queued report jobs and fires due schedules until ctx is
+// cancelled. Jobs and schedules are claimed with conditional updates, so
+// several consumer replicas can run this side by side.
+func StartReports(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient) {
+	if err := os.MkdirAll(cfg.ReportDir, 0o755); err != nil {
+		slog.Error("Failed to create report directory", "dir", cfg.ReportDir, "error", err)
+	}
+
+	ticker := time.NewTicker(cfg.ReportPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := fireDueSchedules(ctx, mongoClient); err != nil {
+			slog.Error("Report scheduling failed", "error", err)
+		}
+		for {
+			job, err := claimReportJob(ctx, mongoClient)
+			if err != nil {
+				slog.Error("Failed to claim report job", "error", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			runReportJob(ctx, cfg, mongoClient, job)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func fireDueSchedules(ctx context.Context, mongoClient *db.MongoClient) error {
+	schedules := mongoClient.Database.Collection("report_schedules")
+	now := time.Now().UTC()
+
+	cursor, err := schedules.Find(ctx, bson.M{"next_run_at": bson.M{"$lte": now}})
+	if err != nil {
+		return err
+	}
+	var due []ReportSchedule
+	if err := cursor.All(ctx, &due); err != nil {
+		return err
+	}
+
+	for _, s := range due {
+		next := s.NextRunAt
+		for !next.After(now) {
+			next = next.Add(s.period())
+		}
+
+		// Only the replica that moves next_run_at creates the job.
+		result, err := schedules.UpdateOne(ctx,
+			bson.M{"_id": s.ID, "next_run_at": s.NextRunAt},
+			bson.M{"$set": bson.M{"next_run_at": next, "last_run_at": now}})
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount == 0 {
+			continue
+		}
+
+		query := AnalyticsQuery{
+			GroupBy: s.GroupBy,
+			Filters: map[string]string{"campaign_id": s.CampaignID},
+			From:    s.NextRunAt.Add(-s.period()),
+			To:      s.NextRunAt,
+		}
+		if _, err := CreateReportJob(mongoClient, query, s.Format, s.ID); err != nil {
+			slog.Error("Failed to create scheduled report", "schedule_id", s.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// claimReportJob takes the oldest queued job, or one left running by a
+// worker that crashed or was stopped.
+func claimReportJob(ctx context.Context, mongoClient *db.MongoClient) (*ReportJob, error) {
+	var job ReportJob
+	err := mongoClient.Database.Collection("report_jobs").FindOneAndUpdate(ctx,
+		bson.M{"$or": bson.A{
+			bson.M{"status": ReportQueued},
+			bson.M{"status": ReportRunning, "started_at": bson.M{"$lt": time.Now().UTC().Add(-reportJobTimeout)}},
+		}},
+		bson.M{"$set": bson.M{"status": ReportRunning, "started_at": time.Now().UTC()}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func runReportJob(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, job *ReportJob) {
+	// Past the timeout the job may be claimed again, so stop writing.
+	runCtx, cancel := context.WithTimeout(ctx, reportJobTimeout)
+	defer cancel()
+
+	job.File = fmt.Sprintf("%s.%s", job.ID, job.Format)
+	rows, err := writeReportFile(runCtx, mongoClient, ReportPath(cfg, job), job.Format, job.Query)
+	update := bson.M{"finished_at": time.Now().UTC()}
+	if err != nil {
+		slog.Error("Report job failed", "job_id", job.ID, "error", err)
+		update["status"] = ReportFailed
+		update["error"] = err.Error()
+	} else {
+		slog.Info("Report job finished", "job_id", job.ID, "rows", rows, "file", job.File)
+		update["status"] = ReportSucceeded
+		update["file"] = job.File
+		update["rows"] = rows
+	}
+
+	if _, err := mongoClient.Database.Collection("report_jobs").UpdateByID(ctx, job.ID, bson.M{"$set": update}); err != nil {
+		slog.Error("Failed to update report job", "job_id", job.ID, "error", err)
+	}
+}
+
+// reportWriter encodes report rows as they are read.
+type reportWriter interface {
+	Write(row QueryRow) error
+	Close() error
+}
+
+// writeReportFile streams the whole query result into the file and returns
+// the number of rows. It writes to a temporary name and renames it into
+// place, so a download never sees a partial file, including on mounted
+// object stores.
+func writeReportFile(ctx context.Context, mongoClient *db.MongoClient, path, format string, query AnalyticsQuery) (int64, error) {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	var w reportWriter
+	if format == ReportParquet {
+		w = newParquetReport(f, query.GroupBy)
+	} else {
+		w = newCSVReport(f, query.GroupBy)
+	}
+	rows, err := streamReportRows(ctx, mongoClient, query, w)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return rows, os.Rename(tmp, path)
+}
+
+// streamReportRows runs the query as one sorted aggregation and writes each
+// row as the cursor returns it, so no more than a batch is held in memory.
+func streamReportRows(ctx context.Context, mongoClient *db.MongoClient, query AnalyticsQuery, w reportWriter) (int64, error) {
+	collection, pipeline := queryPipeline(query)
+	pipeline = append(pipeline, bson.D{{Key: "$sort", Value: querySort(query)}})
+
+	cursor, err := mongoClient.Database.Collection(collection).Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, fmt.Errorf("failed to run report query: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var rows int64
+	for cursor.Next(ctx) {
+		var doc queryRowDoc
+		if err := cursor.Decode(&doc); err != nil {
+			return rows, fmt.Errorf("failed to read report row: %w", err)
+		}
+		if err := w.Write(doc.row()); err != nil {
+			return rows, err
+		}
+		rows++
+	}
+	if err := cursor.Err(); err != nil {
+		return rows, fmt.Errorf("failed to read report query: %w", err)
+	}
+	return rows, w.Close()
+}
+
+func reportValues(row QueryRow) []interface{} {
+	return []interface{}{row.Clicks, row.Impressions, row.Completions, row.CTR, row.CompletionRate}
+}
+
+func dimensionValue(row QueryRow, d string) string {
+	v, ok := row.Dimensions[d]
+	if !ok || v == nil {
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+type csvReport struct {
+	w          *csv.Writer
+	dimensions []string
+	header     bool
+}
+
+func newCSVReport(f io.Writer, dimensions []string) *csvReport {
+	return &csvReport{w: csv.NewWriter(f), dimensions: dimensions}
+}
+
+func (r *csvReport) writeHeader() error {
+	if r.header {
+		return nil
+	}
+	r.header = true
+	return r.w.Write(append(append([]string{}, r.dimensions...), reportMetrics...))
+}
+
+func (r *csvReport) Write(row QueryRow) error {
+	if err := r.writeHeader(); err != nil {
+		return err
+	}
+	record := make([]string, 0, len(r.dimensions)+len(reportMetrics))
+	for _, d := range r.dimensions {
+		record = append(record, dimensionValue(row, d))
+	}
+	record = append(record,
+		strconv.FormatInt(row.Clicks, 10),
+		strconv.FormatInt(row.Impressions, 10),
+		strconv.FormatInt(row.Completions, 10),
+		strconv.FormatFloat(row.CTR, 'f', 4, 64),
+		strconv.FormatFloat(row.CompletionRate, 'f', 4, 64),
+	)
+	return r.w.Write(record)
+}
+
+func (r *csvReport) Close() error {
+	if err := r.writeHeader(); err != nil {
+		return err
+	}
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// parquetReport writes dimensions as string columns and metrics as int64 or
+// double columns. Parquet groups order their columns by name, so each row
+// is assembled in the schema's column order.
+type parquetReport struct {
+	writer     *parquet.GenericWriter[any]
+	dimensions []string
+	columns    []string
+}
+
+func newParquetReport(f io.Writer, dimensions []string) *parquetReport {
+	group := parquet.Group{}
+	for _, d := range dimensions {
+		group[d] = parquet.String()
+	}
+	for i, m := range reportMetrics {
+		if i < 3 {
+			group[m] = parquet.Int(64)
+		} else {
+			group[m] = parquet.Leaf(parquet.DoubleType)
+		}
+	}
+	schema := parquet.NewSchema("report", group)
+
+	columns := make([]string, 0, len(group))
+	for name := range group {
+		columns = append(columns, name)
+	}
+	sort.Strings(columns)
+
+	return &parquetReport{
+		writer:     parquet.NewGenericWriter[any](f, schema),
+		dimensions: dimensions,
+		columns:    columns,
+	}
+}
+
+func (r *parquetReport) Write(row QueryRow) error {
+	values := make(map[string]interface{}, len(r.columns))
+	for _, d := range r.dimensions {
+		values[d] = dimensionValue(row, d)
+	}
+	for i, v := range reportValues(row) {
+		values[reportMetrics[i]] = v
+	}
+
+	record := make(parquet.Row, len(r.columns))
+	for i, name := range r.columns {
+		record[i] = parquet.ValueOf(values[name]).Level(0, 0, i)
+	}
+	_, err := r.writer.WriteRows([]parquet.Row{record})
+	return err
+}
+
+func (r *parquetReport) Close() error {
+	return r.writer.Close()
+}
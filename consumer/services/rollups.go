@@ -0,0 +1,313 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/utils"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	hourlyRollups = "rollups_hourly"
+	dailyRollups  = "rollups_daily"
+
+	// rollupDirtyKey is a Redis set of "<ad_id>|<YYYYMMDDHH>" hours that
+	// received events since they were last rolled up.
+	rollupDirtyKey   = "rollups:dirty"
+	rollupBatchSize  = 500
+	rollupHourLayout = "2006010215"
+)
+
+// Rollup is a durable per-ad aggregate for one hour or one day. Rollups are
+// always recomputed from click_events rather than incremented, so rebuilding
+// a bucket any number of times yields the same document.
+type Rollup struct {
+	ID              string            `bson:"_id" json:"-"`
+	AdID            string            `bson:"ad_id" json:"ad_id"`
+	CampaignID      string            `bson:"campaign_id,omitempty" json:"campaign_id,omitempty"`
+	Granularity     string            `bson:"granularity" json:"granularity"`
+	Bucket          time.Time         `bson:"bucket" json:"bucket"`
+	Clicks          int64             `bson:"clicks" json:"clicks"`
+	Impressions     int64             `bson:"impressions" json:"impressions"`
+	Completions     int64             `bson:"completions" json:"completions"`
+	PlaybackSeconds int64             `bson:"playback_seconds" json:"playback_seconds"`
+	Playback        PlaybackHistogram `bson:"playback" json:"playback"`
+	UpdatedAt       time.Time         `bson:"updated_at" json:"updated_at"`
+}
+
+func (r *Rollup) add(metric string, n int64) {
+	switch metric {
+	case "clicks":
+		r.Clicks += n
+	case "impressions":
+		r.Impressions += n
+	case "completions":
+		r.Completions += n
+	}
+}
+
+func rollupID(adID string, bucket time.Time, layout string) string {
+	return adID + "|" + bucket.UTC().Format(layout)
+}
+
+// markRollupDirty queues the event's hour for recomputation. Late events
+// mark old hours, which is how they reach the rollups.
+func markRollupDirty(ctx context.Context, event ClickEvent, redisClient *db.RedisClient) error {
+	member := rollupID(event.AdID, event.Timestamp, rollupHourLayout)
+	if err := redisClient.Client.SAdd(ctx, rollupDirtyKey, member).Err(); err != nil {
+		return fmt.Errorf("failed to mark rollup dirty: %w", err)
+	}
+	return nil
+}
+
+// StartRollups rebuilds the rollups for recently active hours on startup,
+// then recomputes dirty hours every interval until ctx is cancelled.
+func StartRollups(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient, redisClient *db.RedisClient) {
+	if err := ensureRollupIndexes(ctx, mongoClient); err != nil {
+		slog.Error("Failed to create rollup indexes", "error", err)
+	}
+	if n, err := SweepRollups(ctx, mongoClient, time.Now().UTC().Add(-cfg.RollupLookback), time.Now().UTC()); err != nil {
+		slog.Error("Rollup sweep failed", "error", err)
+	} else {
+		slog.Info("Rollup sweep finished", "buckets", n)
+	}
+
+	ticker := time.NewTicker(cfg.RollupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n, err := processDirtyRollups(ctx, mongoClient, redisClient); err != nil {
+			slog.Error("Rollup run failed", "error", err)
+		} else if n > 0 {
+			slog.Info("Rolled up hourly buckets", "buckets", n)
+		}
+	}
+}
+
+func ensureRollupIndexes(ctx context.Context, mongoClient *db.MongoClient) error {
+	_, err := mongoClient.Database.Collection("click_events").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ad_id", Value: 1}, {Key: "timestamp", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{hourlyRollups, dailyRollups} {
+		_, err := mongoClient.Database.Collection(name).Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys: bson.D{{Key: "ad_id", Value: 1}, {Key: "bucket", Value: 1}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func processDirtyRollups(ctx context.Context, mongoClient *db.MongoClient, redisClient *db.RedisClient) (int, error) {
+	total := 0
+	for {
+		members, err := redisClient.Client.SPopN(ctx, rollupDirtyKey, rollupBatchSize).Result()
+		if err != nil {
+			return total, fmt.Errorf("failed to pop dirty rollups: %w", err)
+		}
+		if len(members) == 0 {
+			return total, nil
+		}
+
+		for i, member := range members {
+			adID, hour, ok := parseRollupMember(member)
+			if !ok {
+				slog.Warn("Dropping malformed rollup marker", "member", member)
+				continue
+			}
+			if err := RebuildRollup(ctx, mongoClient, adID, hour); err != nil {
+				// Requeue what was popped but not rebuilt.
+				redisClient.Client.SAdd(ctx, rollupDirtyKey, toInterfaces(members[i:])...)
+				return total, err
+			}
+			total++
+		}
+	}
+}
+
+func parseRollupMember(member string) (string, time.Time, bool) {
+	i := strings.LastIndex(member, "|")
+	if i <= 0 {
+		return "", time.Time{}, false
+	}
+	hour, err := time.Parse(rollupHourLayout, member[i+1:])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return member[:i], hour, true
+}
+
+func toInterfaces(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+// SweepRollups rebuilds every ad-hour that has events between from and to.
+// It repairs rollups whose dirty markers were lost, e.g. after a Redis flush.
+func SweepRollups(ctx context.Context, mongoClient *db.MongoClient, from, to time.Time) (int, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"timestamp": bson.M{"$gte": from, "$lt": to}}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{
+			"ad_id": "$ad_id",
+			"hour":  bson.M{"$dateTrunc": bson.M{"date": "$timestamp", "unit": "hour"}},
+		}}}},
+	}
+	cursor, err := mongoClient.Database.Collection("click_events").Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list active hours: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	n := 0
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				AdID string    `bson:"ad_id"`
+				Hour time.Time `bson:"hour"`
+			} `bson:"_id"`
+		}
+		if err := cursor.Decode(&row); err != nil {
+			return n, err
+		}
+		if err := RebuildRollup(ctx, mongoClient, row.ID.AdID, row.ID.Hour); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, cursor.Err()
+}
+
+// RebuildRollup recomputes the hourly rollup for adID at hour from raw
+// events, then the daily rollup containing it from the hourly rollups.
+func RebuildRollup(ctx context.Context, mongoClient *db.MongoClient, adID string, hour time.Time) error {
+	hour = hour.UTC().Truncate(time.Hour)
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"ad_id":     adID,
+			"timestamp": bson.M{"$gte": hour, "$lt": hour.Add(time.Hour)},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":         "$event_type",
+			"count":       bson.M{"$sum": 1},
+			"campaign_id": bson.M{"$max": "$campaign_id"},
+		}}},
+	}
+	cursor, err := mongoClient.Database.Collection("click_events").Aggregate(ctx, pipeline)
+	if err != nil {
+		return fmt.Errorf("failed to aggregate hour %s for %s: %w", hour.Format(rollupHourLayout), adID, err)
+	}
+	var rows []struct {
+		EventType  string `bson:"_id"`
+		Count      int64  `bson:"count"`
+		CampaignID string `bson:"campaign_id"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return err
+	}
+
+	hourly := Rollup{
+		ID:          rollupID(adID, hour, rollupHourLayout),
+		AdID:        adID,
+		Granularity: GranularityHour,
+		Bucket:      hour,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	for _, row := range rows {
+		hourly.add(metricName(row.EventType), row.Count)
+		if row.CampaignID != "" {
+			hourly.CampaignID = row.CampaignID
+		}
+	}
+	if hourly.Playback, err = aggregatePlayback(ctx, mongoClient, adID, hour); err != nil {
+		return err
+	}
+	hourly.PlaybackSeconds = hourly.Playback.Sum
+	if err := saveRollup(ctx, mongoClient, hourlyRollups, hourly); err != nil {
+		return err
+	}
+
+	return rebuildDailyRollup(ctx, mongoClient, adID, hour.Truncate(24*time.Hour))
+}
+
+func rebuildDailyRollup(ctx context.Context, mongoClient *db.MongoClient, adID string, day time.Time) error {
+	cursor, err := mongoClient.Database.Collection(hourlyRollups).Find(ctx, bson.M{
+		"ad_id":  adID,
+		"bucket": bson.M{"$gte": day, "$lt": day.Add(24 * time.Hour)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read hourly rollups: %w", err)
+	}
+	var hours []Rollup
+	if err := cursor.All(ctx, &hours); err != nil {
+		return err
+	}
+
+	daily := Rollup{
+		ID:          rollupID(adID, day, "20060102"),
+		AdID:        adID,
+		Granularity: GranularityDay,
+		Bucket:      day,
+		UpdatedAt:   time.Now().UTC(),
+	}
+	for _, h := range hours {
+		daily.Clicks += h.Clicks
+		daily.Impressions += h.Impressions
+		daily.Completions += h.Completions
+		daily.PlaybackSeconds += h.PlaybackSeconds
+		daily.Playback.merge(h.Playback)
+		if h.CampaignID != "" {
+			daily.CampaignID = h.CampaignID
+		}
+	}
+	return saveRollup(ctx, mongoClient, dailyRollups, daily)
+}
+
+func saveRollup(ctx context.Context, mongoClient *db.MongoClient, collection string, r Rollup) error {
+	_, err := mongoClient.Database.Collection(collection).ReplaceOne(ctx, bson.M{"_id": r.ID}, r, options.Replace().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to save rollup %s: %w", r.ID, err)
+	}
+	return nil
+}
+
+// readRollups returns the stored rollups for an ad in [from, to).
+func readRollups(ctx context.Context, mongoClient *db.MongoClient, adID, granularity string, from, to time.Time) ([]Rollup, error) {
+	collection := hourlyRollups
+	if granularity == GranularityDay {
+		collection = dailyRollups
+	}
+
+	cursor, err := mongoClient.Database.Collection(collection).Find(ctx, bson.M{
+		"ad_id":  adID,
+		"bucket": bson.M{"$gte": from, "$lt": to},
+	}, options.Find().SetSort(bson.D{{Key: "bucket", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollups: %w", err)
+	}
+	var rollups []Rollup
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+	return rollups, nil
+}
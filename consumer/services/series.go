@@ -0,0 +1,267 @@
+package services
+
+import (
+	"consumer/db"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	GranularityMinute = "minute"
+	GranularityHour   = "hour"
+	GranularityDay    = "day"
+
+	// MaxSeriesPoints bounds a single series request.
+	MaxSeriesPoints = 2000
+)
+
+// granularitySpec describes one bucket family written by updateRedisAnalytics.
+type granularitySpec struct {
+	name      string
+	size      time.Duration
+	layout    string
+	retention time.Duration
+}
+
+var granularities = map[string]granularitySpec{
+	GranularityMinute: {GranularityMinute, time.Minute, "200601021504", time.Hour},
+	GranularityHour:   {GranularityHour, time.Hour, "2006010215", 24 * time.Hour},
+	GranularityDay:    {GranularityDay, 24 * time.Hour, "20060102", 7 * 24 * time.Hour},
+}
+
+// seriesMetrics are the counter families a series point is built from.
+var seriesMetrics = []string{"clicks", "impressions", "completions"}
+
+type SeriesPoint struct {
+	Start          time.Time `json:"start"`
+	Clicks         int64     `json:"clicks"`
+	Impressions    int64     `json:"impressions"`
+	Completions    int64     `json:"completions"`
+	CTR            float64   `json:"ctr_percentage"`
+	CompletionRate float64   `json:"completion_rate_percentage"`
+	Source         string    `json:"source"`
+}
+
+type AdSeries struct {
+	AdID        string        `json:"ad_id"`
+	Granularity string        `json:"granularity"`
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	Points      []SeriesPoint `json:"points"`
+	Totals      SeriesPoint   `json:"totals"`
+	Reach       ReachStats    `json:"reach"`
+}
+
+func (p *SeriesPoint) add(metric string, n int64) {
+	switch metric {
+	case "clicks":
+		p.Clicks += n
+	case "impressions":
+		p.Impressions += n
+	case "completions":
+		p.Completions += n
+	}
+}
+
+func (p *SeriesPoint) derive() {
+	if p.Impressions > 0 {
+		p.CTR = float64(p.Clicks) / float64(p.Impressions) * 100
+		p.CompletionRate = float64(p.Completions) / float64(p.Impressions) * 100
+	}
+}
+
+// ValidGranularity reports whether g names a supported bucket size.
+func ValidGranularity(g string) bool {
+	_, ok := granularities[g]
+	return ok
+}
+
+// SeriesBuckets returns the bucket start times covering [from, to).
+func SeriesBuckets(from, to time.Time, granularity string) []time.Time {
+	spec := granularities[granularity]
+	var buckets []time.Time
+	for t := from.UTC().Truncate(spec.size); t.Before(to); t = t.Add(spec.size) {
+		buckets = append(buckets, t)
+	}
+	return buckets
+}
+
+// SeriesBucketCount returns len(SeriesBuckets(from, to, granularity))
+// without building the slice, so oversized ranges can be rejected first.
+func SeriesBucketCount(from, to time.Time, granularity string) int64 {
+	spec := granularities[granularity]
+	start := from.UTC().Truncate(spec.size)
+	if !start.Before(to) {
+		return 0
+	}
+	span := to.Sub(start)
+	return int64((span + spec.size - 1) / spec.size)
+}
+
+// GetAdSeries returns per-bucket counters for an ad between from and to.
+// Buckets still inside their Redis retention are read from the counters
+// written by updateRedisAnalytics; older buckets come from the Mongo
+// rollups, or from raw events for minute granularity.
+func GetAdSeries(mongoClient *db.MongoClient, redisClient *db.RedisClient, adID string, from, to time.Time, granularity string) (*AdSeries, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	spec := granularities[granularity]
+	buckets := SeriesBuckets(from, to, granularity)
+	series := &AdSeries{AdID: adID, Granularity: granularity, From: from.UTC(), To: to.UTC()}
+	series.Points = make([]SeriesPoint, len(buckets))
+
+	// A bucket is complete in Redis only if every write to it happened
+	// after the oldest moment whose TTL has not yet run out.
+	redisFrom := time.Now().UTC().Add(-spec.retention)
+	var redisBuckets, mongoBuckets []int
+	for i, start := range buckets {
+		series.Points[i].Start = start
+		if start.Before(redisFrom) {
+			series.Points[i].Source = "mongo"
+			mongoBuckets = append(mongoBuckets, i)
+		} else {
+			series.Points[i].Source = "redis"
+			redisBuckets = append(redisBuckets, i)
+		}
+	}
+
+	if err := readRedisBuckets(ctx, redisClient, adID, spec, series.Points, redisBuckets); err != nil {
+		return nil, err
+	}
+	if err := readMongoBuckets(ctx, mongoClient, adID, granularity, series.Points, mongoBuckets); err != nil {
+		return nil, err
+	}
+
+	series.Totals.Start = series.From
+	for i := range series.Points {
+		series.Points[i].derive()
+		series.Totals.Clicks += series.Points[i].Clicks
+		series.Totals.Impressions += series.Points[i].Impressions
+		series.Totals.Completions += series.Points[i].Completions
+	}
+	series.Totals.derive()
+
+	reach, err := GetReach(ctx, redisClient, adID, series.From, series.To, series.Totals.Impressions)
+	if err != nil {
+		return nil, err
+	}
+	series.Reach = reach
+	return series, nil
+}
+
+func readRedisBuckets(ctx context.Context, redisClient *db.RedisClient, adID string, spec granularitySpec, points []SeriesPoint, indexes []int) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(indexes)*len(seriesMetrics))
+	for _, i := range indexes {
+		for _, metric := range seriesMetrics {
+			keys = append(keys, bucketKey(metric, spec, adID, points[i].Start))
+		}
+	}
+
+	values, err := redisClient.Client.MGet(ctx, keys...).Result()
+	if err != nil && err != redis.Nil {
+		return fmt.Errorf("failed to read series buckets: %w", err)
+	}
+
+	for n, i := range indexes {
+		for m, metric := range seriesMetrics {
+			if s, ok := values[n*len(seriesMetrics)+m].(string); ok {
+				count, _ := strconv.ParseInt(s, 10, 64)
+				points[i].add(metric, count)
+			}
+		}
+	}
+	return nil
+}
+
+func bucketKey(metric string, spec granularitySpec, adID string, start time.Time) string {
+	return fmt.Sprintf("%s:%s:%s:%s", metric, spec.name, adID, start.UTC().Format(spec.layout))
+}
+
+// readMongoBuckets fills the buckets Redis has expired from the hourly or
+// daily rollups, or from raw click_events for minute granularity.
+func readMongoBuckets(ctx context.Context, mongoClient *db.MongoClient, adID, granularity string, points []SeriesPoint, indexes []int) error {
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	spec := granularities[granularity]
+	from := points[indexes[0]].Start
+	to := points[indexes[len(indexes)-1]].Start.Add(spec.size)
+
+	if granularity == GranularityMinute {
+		return readRawBuckets(ctx, mongoClient, adID, granularity, from, to, points, indexes)
+	}
+
+	rollups, err := readRollups(ctx, mongoClient, adID, granularity, from, to)
+	if err != nil {
+		return err
+	}
+
+	byStart := make(map[int64]int, len(indexes))
+	for _, i := range indexes {
+		byStart[points[i].Start.Unix()] = i
+	}
+	for _, r := range rollups {
+		if i, ok := byStart[r.Bucket.UTC().Unix()]; ok {
+			points[i].Clicks += r.Clicks
+			points[i].Impressions += r.Impressions
+			points[i].Completions += r.Completions
+		}
+	}
+	return nil
+}
+
+// readRawBuckets aggregates click_events directly, for granularities finer
+// than the stored rollups.
+func readRawBuckets(ctx context.Context, mongoClient *db.MongoClient, adID, granularity string, from, to time.Time, points []SeriesPoint, indexes []int) error {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{
+			"ad_id":     adID,
+			"timestamp": bson.M{"$gte": from, "$lt": to},
+		}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"bucket":     bson.M{"$dateTrunc": bson.M{"date": "$timestamp", "unit": granularity}},
+				"event_type": "$event_type",
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+	}
+
+	cursor, err := mongoClient.Database.Collection("click_events").Aggregate(ctx, pipeline)
+	if err != nil {
+		return fmt.Errorf("failed to aggregate series buckets: %w", err)
+	}
+	var rows []struct {
+		ID struct {
+			Bucket    time.Time `bson:"bucket"`
+			EventType string    `bson:"event_type"`
+		} `bson:"_id"`
+		Count int64 `bson:"count"`
+	}
+	if err := cursor.All(ctx, &rows); err != nil {
+		return fmt.Errorf("failed to read series buckets: %w", err)
+	}
+
+	byStart := make(map[int64]int, len(indexes))
+	for _, i := range indexes {
+		byStart[points[i].Start.Unix()] = i
+	}
+	for _, row := range rows {
+		if i, ok := byStart[row.ID.Bucket.UTC().Unix()]; ok {
+			points[i].add(metricName(row.ID.EventType), row.Count)
+		}
+	}
+	return nil
+}
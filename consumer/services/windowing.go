@@ -0,0 +1,147 @@
+package services
+
+import (
+	"consumer/db"
+	"consumer/stream"
+	"consumer/utils"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	windowEngine     *stream.Engine
+	windowEngineOnce sync.Once
+)
+
+func windowEngineFor(cfg utils.Config) *stream.Engine {
+	windowEngineOnce.Do(func() {
+		windows := make([]stream.Window, len(cfg.StreamWindows))
+		for i, spec := range cfg.StreamWindows {
+			windows[i] = stream.Window{Size: spec.Size, Slide: spec.Slide}
+		}
+		windowEngine = stream.NewEngine(stream.Config{
+			Windows:         windows,
+			WatermarkLag:    cfg.WatermarkLag,
+			AllowedLateness: cfg.AllowedLateness,
+			IdleTimeout:     cfg.WatermarkIdle,
+		})
+	})
+	return windowEngine
+}
+
+// recordWindowed feeds the event into the event-time window engine, stores
+// any window results it produced and side-outputs it to late_events when it
+// arrived after the allowed lateness.
+func recordWindowed(ctx context.Context, event ClickEvent, cfg utils.Config, mongoClient *db.MongoClient) error {
+	engine := windowEngineFor(cfg)
+	results, tooLate := engine.Process(stream.Event{
+		Key:    event.AdID,
+		Metric: metricName(event.EventType),
+		Time:   event.Timestamp,
+	})
+
+	if err := storeWindowResults(ctx, mongoClient, results); err != nil {
+		return err
+	}
+	if tooLate {
+		return storeLateEvent(ctx, mongoClient, event, engine.Watermark())
+	}
+	return nil
+}
+
+// StartWindowing advances the watermark of an idle stream so its last
+// windows still fire, until ctx is cancelled.
+func StartWindowing(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient) {
+	engine := windowEngineFor(cfg)
+	if err := ensureWindowIndexes(ctx, mongoClient); err != nil {
+		slog.Error("Failed to create window indexes", "error", err)
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := storeWindowResults(ctx, mongoClient, engine.Tick(now)); err != nil {
+				slog.Error("Failed to store window results", "error", err)
+			}
+		}
+	}
+}
+
+// FlushWindows stores the results of every window still open. The replay
+// command calls it once its input is exhausted, and the service on shutdown
+// once the consumer has stopped, since open windows live only in memory.
+func FlushWindows(ctx context.Context, cfg utils.Config, mongoClient *db.MongoClient) error {
+	return storeWindowResults(ctx, mongoClient, windowEngineFor(cfg).Flush())
+}
+
+func ensureWindowIndexes(ctx context.Context, mongoClient *db.MongoClient) error {
+	_, err := mongoClient.Database.Collection("windowed_counts").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "ad_id", Value: 1}, {Key: "window", Value: 1}, {Key: "start", Value: 1}},
+	})
+	return err
+}
+
+// storeWindowResults adds each result's delta to its window's count. Adding
+// rather than replacing keeps the counts flushed before a restart, and
+// leaves the total right whatever order concurrent results are written in.
+func storeWindowResults(ctx context.Context, mongoClient *db.MongoClient, results []stream.Result) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, 0, len(results))
+	now := time.Now().UTC()
+	for _, r := range results {
+		id := fmt.Sprintf("%s|%s|%s|%d", r.Key, r.Metric, r.Window, r.Start.Unix())
+		update := bson.M{
+			"$set": bson.M{
+				"ad_id":      r.Key,
+				"metric":     r.Metric,
+				"window":     r.Window.String(),
+				"start":      r.Start,
+				"end":        r.End,
+				"updated_at": now,
+			},
+		}
+		inc := bson.M{"count": r.Delta}
+		if r.Late {
+			inc["late_updates"] = 1
+		}
+		update["$inc"] = inc
+		models = append(models, mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": id}).SetUpdate(update).SetUpsert(true))
+	}
+
+	_, err := mongoClient.Database.Collection("windowed_counts").BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("failed to store window results: %w", err)
+	}
+	return nil
+}
+
+func storeLateEvent(ctx context.Context, mongoClient *db.MongoClient, event ClickEvent, watermark time.Time) error {
+	document := map[string]interface{}{
+		"event":       event,
+		"watermark":   watermark,
+		"lateness":    watermark.Sub(event.Timestamp).String(),
+		"received_at": time.Now().UTC(),
+	}
+	if _, err := mongoClient.Database.Collection("late_events").InsertOne(ctx, document); err != nil {
+		return fmt.Errorf("failed to store late event: %w", err)
+	}
+
+	slog.WarnContext(ctx, "Event is beyond allowed lateness",
+		"ad_id", event.AdID, "timestamp", event.Timestamp, "watermark", watermark)
+	return nil
+}
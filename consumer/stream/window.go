@@ -0,0 +1,216 @@
+// Package stream implements event-time windowed counting with watermarks.
+//
+// Events are assigned to tumbling or sliding windows by their own timestamp.
+// The watermark trails the newest event time by a fixed lag; a window fires
+// once the watermark passes its end and keeps accepting late events for the
+// allowed lateness, re-emitting its updated count each time. Events that
+// arrive after that are reported as too late instead of being counted. The
+// watermark never passes processing time less the lag, so an event stamped
+// in the future cannot close windows before their events arrive.
+package stream
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Window describes one family of windows. A window whose Slide is zero or
+// equal to its Size is tumbling; otherwise windows overlap and every event
+// falls into Size/Slide of them.
+type Window struct {
+	Size  time.Duration
+	Slide time.Duration
+}
+
+func (w Window) slide() time.Duration {
+	if w.Slide <= 0 || w.Slide > w.Size {
+		return w.Size
+	}
+	return w.Slide
+}
+
+func (w Window) String() string {
+	if w.slide() == w.Size {
+		return "tumbling:" + w.Size.String()
+	}
+	return fmt.Sprintf("sliding:%s/%s", w.Size, w.slide())
+}
+
+// assign returns the start of every window of this family containing t.
+func (w Window) assign(t time.Time) []time.Time {
+	slide := w.slide()
+	last := t.Truncate(slide)
+	var starts []time.Time
+	for start := last; start.After(t.Add(-w.Size)); start = start.Add(-slide) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+type Config struct {
+	Windows         []Window
+	WatermarkLag    time.Duration
+	AllowedLateness time.Duration
+	// IdleTimeout lets the watermark follow processing time when no events
+	// arrive, so the last windows of a quiet stream still fire.
+	IdleTimeout time.Duration
+}
+
+// Event is one occurrence to be counted under Key and Metric at Time.
+type Event struct {
+	Key    string
+	Metric string
+	Time   time.Time
+}
+
+// Result is the count of one window. Count covers every event this engine
+// counted in the window and Delta those since its previous result, so
+// results can be summed across engines, e.g. before and after a restart.
+// Late is set when the window had already fired.
+type Result struct {
+	Key    string
+	Metric string
+	Window Window
+	Start  time.Time
+	End    time.Time
+	Count  int64
+	Delta  int64
+	Late   bool
+}
+
+type windowID struct {
+	key    string
+	metric string
+	window Window
+	start  time.Time
+}
+
+type windowState struct {
+	count   int64
+	emitted int64
+	fired   bool
+}
+
+// result reports the window's count and marks it emitted.
+func (s *windowState) result(id windowID) Result {
+	r := Result{
+		Key: id.key, Metric: id.metric, Window: id.window,
+		Start: id.start, End: id.start.Add(id.window.Size),
+		Count: s.count, Delta: s.count - s.emitted, Late: s.fired,
+	}
+	s.emitted = s.count
+	s.fired = true
+	return r
+}
+
+// Engine holds the open windows and the watermark. It is safe for
+// concurrent use.
+type Engine struct {
+	cfg Config
+
+	mu          sync.Mutex
+	watermark   time.Time
+	lastEventAt time.Time
+	windows     map[windowID]*windowState
+}
+
+func NewEngine(cfg Config) *Engine {
+	return &Engine{cfg: cfg, windows: make(map[windowID]*windowState)}
+}
+
+// Watermark returns the current event-time watermark.
+func (e *Engine) Watermark() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.watermark
+}
+
+// Process counts the event and returns every result it caused: windows the
+// advancing watermark closed, and updates of already fired windows the
+// event arrived late for. tooLate reports that the event was past the
+// allowed lateness of every window it belongs to and was not counted.
+func (e *Engine) Process(ev Event) (results []Result, tooLate bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.lastEventAt = time.Now()
+	ev.Time = ev.Time.UTC()
+	counted := false
+	for _, w := range e.cfg.Windows {
+		for _, start := range w.assign(ev.Time) {
+			end := start.Add(w.Size)
+			if !end.Add(e.cfg.AllowedLateness).After(e.watermark) {
+				continue
+			}
+
+			id := windowID{key: ev.Key, metric: ev.Metric, window: w, start: start}
+			state := e.windows[id]
+			if state == nil {
+				state = &windowState{}
+				e.windows[id] = state
+			}
+			state.count++
+			counted = true
+
+			// The watermark already passed this window: emit now, as an
+			// update if it fired before.
+			if !end.After(e.watermark) {
+				results = append(results, state.result(id))
+			}
+		}
+	}
+
+	candidate := ev.Time.Add(-e.cfg.WatermarkLag)
+	if limit := e.lastEventAt.UTC().Add(-e.cfg.WatermarkLag); candidate.After(limit) {
+		candidate = limit
+	}
+	results = append(results, e.advance(candidate)...)
+	return results, !counted
+}
+
+// Tick advances the watermark with processing time once the stream has been
+// idle for IdleTimeout, and returns the windows that closed. Before the
+// first event it does nothing, so a backlog read after a restart is not
+// already behind the watermark.
+func (e *Engine) Tick(now time.Time) []Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cfg.IdleTimeout <= 0 || e.lastEventAt.IsZero() || now.Sub(e.lastEventAt) < e.cfg.IdleTimeout {
+		return nil
+	}
+	return e.advance(now.Add(-e.cfg.WatermarkLag))
+}
+
+// Flush fires every window still open and drops all state, for a stream
+// that has ended, such as a replay.
+func (e *Engine) Flush() []Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.advance(time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// advance moves the watermark forward, fires windows it passed and drops
+// windows beyond their allowed lateness. Callers hold e.mu.
+func (e *Engine) advance(candidate time.Time) []Result {
+	if !candidate.After(e.watermark) {
+		return nil
+	}
+	e.watermark = candidate
+
+	var results []Result
+	for id, state := range e.windows {
+		end := id.start.Add(id.window.Size)
+		if !state.fired && !end.After(e.watermark) {
+			results = append(results, state.result(id))
+		}
+		if !end.Add(e.cfg.AllowedLateness).After(e.watermark) {
+			delete(e.windows, id)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Start.Before(results[j].Start) })
+	return results
+}
@@ -0,0 +1,113 @@
+// Package tracing configures OpenTelemetry for the consumer and continues
+// traces started by the producer from Kafka message headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "consumer"
+
+// Init installs the global tracer provider and W3C propagator. exporter is
+// "otlp" (configured by the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout", or "none" to keep tracing disabled. The returned function
+// flushes buffered spans.
+func Init(exporter string, sampleRatio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", exporter, "sample_ratio", sampleRatio)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the consumer's tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// HeaderCarrier adapts Kafka message headers to the propagation API.
+type HeaderCarrier struct {
+	Headers *[]kafka.Header
+}
+
+func (c HeaderCarrier) Get(key string) string {
+	for _, h := range *c.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	for i, h := range *c.Headers {
+		if h.Key == key {
+			(*c.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.Headers = append(*c.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, len(*c.Headers))
+	for i, h := range *c.Headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// Extract returns ctx carrying the trace context found in the message
+// headers, if any.
+func Extract(ctx context.Context, message kafka.Message) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, HeaderCarrier{Headers: &message.Headers})
+}
+
+// StartClient starts a span for a call to Mongo, Redis or another backend.
+func StartClient(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
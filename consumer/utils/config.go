@@ -1,9 +1,14 @@
 package utils
 
 import (
-	"log"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -15,6 +20,71 @@ type Config struct {
 	MongoURI      string
 	MongoDB       string
 	RedisAddr     string
+
+	UserHashSalt  string
+	FrequencyCaps []FrequencyCap
+
+	BudgetSyncInterval     time.Duration
+	ExperimentSyncInterval time.Duration
+
+	AttributionInterval time.Duration
+	ClickLookback       time.Duration
+	ViewLookback        time.Duration
+
+	RollupInterval time.Duration
+	// RollupLookback is how far back the startup sweep rebuilds rollups.
+	// Older history is rolled up once with the sweep-rollups command.
+	RollupLookback time.Duration
+
+	StreamWindows   []WindowSpec
+	WatermarkLag    time.Duration
+	AllowedLateness time.Duration
+	WatermarkIdle   time.Duration
+
+	ReportDir          string
+	ReportPollInterval time.Duration
+
+	LiveHeartbeat time.Duration
+
+	TraceExporter    string
+	TraceSampleRatio float64
+
+	LogLevel       string
+	LogSampleEvery int
+
+	ReadyTimeout    time.Duration
+	ShutdownTimeout time.Duration
+
+	LagInterval        time.Duration
+	LagThreshold       int64
+	LagGrowthThreshold float64
+
+	ReconcileInterval time.Duration
+	ReconcileLookback time.Duration
+	ReconcileRepair   bool
+
+	// KafkaStartOffset is where the group starts reading a partition it has
+	// never committed to: "earliest" or "latest".
+	KafkaStartOffset string
+
+	// Replay is set by the replay command, which writes to a scratch
+	// namespace and must not publish live updates.
+	Replay bool
+}
+
+// WindowSpec configures one family of event-time windows. Slide equals Size
+// for tumbling windows.
+type WindowSpec struct {
+	Size  time.Duration
+	Slide time.Duration
+}
+
+// FrequencyCap limits how many impressions one user may see of a single ad
+// or campaign within a rolling window.
+type FrequencyCap struct {
+	Scope  string // "ad" or "campaign"
+	Limit  int
+	Window time.Duration
 }
 
 func LoadConfig() Config {
@@ -28,7 +98,7 @@ func LoadConfig() Config {
 	for _, path := range envPaths {
 		if _, err := os.Stat(path); err == nil {
 			if err := godotenv.Load(path); err == nil {
-				log.Printf("Loaded environment from %s", path)
+				slog.Debug("Loaded environment", "path", path)
 				break
 			}
 		}
@@ -47,7 +117,139 @@ func LoadConfig() Config {
 		MongoURI:      getEnv("MONGO_URI", "mongodb://localhost:27017/"),
 		MongoDB:       getEnv("MONGO_DB", "video_ads"),
 		RedisAddr:     getEnv("REDIS_ADDR", "localhost:6379"),
+
+		UserHashSalt:  userHashSalt(),
+		FrequencyCaps: parseFrequencyCaps(getEnv("FREQUENCY_CAPS", "campaign:3:24h")),
+
+		BudgetSyncInterval:     getEnvDuration("BUDGET_SYNC_INTERVAL", 30*time.Second),
+		ExperimentSyncInterval: getEnvDuration("EXPERIMENT_SYNC_INTERVAL", 30*time.Second),
+
+		AttributionInterval: getEnvDuration("ATTRIBUTION_INTERVAL", time.Minute),
+		ClickLookback:       getEnvDuration("ATTRIBUTION_CLICK_LOOKBACK", 7*24*time.Hour),
+		ViewLookback:        getEnvDuration("ATTRIBUTION_VIEW_LOOKBACK", 24*time.Hour),
+
+		RollupInterval: getEnvDuration("ROLLUP_INTERVAL", time.Minute),
+		RollupLookback: getEnvDuration("ROLLUP_LOOKBACK", 48*time.Hour),
+
+		StreamWindows:   parseWindowSpecs(getEnv("STREAM_WINDOWS", "tumbling:1m,tumbling:1h,sliding:10m/1m")),
+		WatermarkLag:    getEnvDuration("WATERMARK_LAG", 30*time.Second),
+		AllowedLateness: getEnvDuration("ALLOWED_LATENESS", 10*time.Minute),
+		WatermarkIdle:   getEnvDuration("WATERMARK_IDLE_TIMEOUT", time.Minute),
+
+		ReportDir:          getEnv("REPORT_DIR", "reports"),
+		ReportPollInterval: getEnvDuration("REPORT_POLL_INTERVAL", 10*time.Second),
+
+		LiveHeartbeat: getEnvDuration("LIVE_HEARTBEAT_INTERVAL", 15*time.Second),
+
+		TraceExporter:    getEnv("TRACE_EXPORTER", "none"),
+		TraceSampleRatio: getEnvFloat("TRACE_SAMPLE_RATIO", 1),
+
+		LogLevel:       getEnv("LOG_LEVEL", "info"),
+		LogSampleEvery: getEnvInt("LOG_SAMPLE_EVERY", 100),
+
+		ReadyTimeout:    getEnvDuration("READY_TIMEOUT", 2*time.Second),
+		ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+
+		LagInterval:        getEnvDuration("LAG_CHECK_INTERVAL", 30*time.Second),
+		LagThreshold:       int64(getEnvInt("LAG_THRESHOLD", 10000)),
+		LagGrowthThreshold: getEnvFloat("LAG_GROWTH_THRESHOLD", 100),
+
+		ReconcileInterval: getEnvDuration("RECONCILE_INTERVAL", 15*time.Minute),
+		ReconcileLookback: getEnvDuration("RECONCILE_LOOKBACK", 6*time.Hour),
+		ReconcileRepair:   getEnvBool("RECONCILE_REPAIR", false),
+
+		KafkaStartOffset: getEnv("KAFKA_START_OFFSET", "latest"),
+	}
+}
+
+// userHashSalt returns USER_HASH_SALT. A salt shipped as a default would let
+// anyone who knows it hash candidate user IDs or IPs and match them, so
+// without one a random salt is used. Its hashes change on every restart and
+// differ between replicas, which resets frequency caps and unique counts.
+func userHashSalt() string {
+	if salt := getEnv("USER_HASH_SALT", ""); salt != "" {
+		return salt
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		slog.Error("Failed to generate user hash salt", "error", err)
+		os.Exit(1)
+	}
+	slog.Error("USER_HASH_SALT is not set; using a random salt, so user hashes will not match across restarts or replicas")
+	return hex.EncodeToString(b)
+}
+
+// parseFrequencyCaps reads a comma separated list of scope:limit:window
+// entries, e.g. "campaign:3:24h,ad:1:10m". Malformed entries are skipped.
+func parseFrequencyCaps(value string) []FrequencyCap {
+	var caps []FrequencyCap
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || (parts[0] != "ad" && parts[0] != "campaign") {
+			slog.Warn("Ignoring invalid frequency cap", "entry", entry)
+			continue
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil || limit <= 0 {
+			slog.Warn("Ignoring frequency cap with invalid limit", "entry", entry)
+			continue
+		}
+		window, err := time.ParseDuration(parts[2])
+		if err != nil || window <= 0 {
+			slog.Warn("Ignoring frequency cap with invalid window", "entry", entry)
+			continue
+		}
+
+		caps = append(caps, FrequencyCap{Scope: parts[0], Limit: limit, Window: window})
+	}
+	return caps
+}
+
+// parseWindowSpecs reads a comma separated list of "tumbling:<size>" and
+// "sliding:<size>/<slide>" entries. Malformed entries are skipped.
+func parseWindowSpecs(value string) []WindowSpec {
+	var specs []WindowSpec
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kind, sizes, ok := strings.Cut(entry, ":")
+		if !ok {
+			slog.Warn("Ignoring invalid stream window", "entry", entry)
+			continue
+		}
+		sizeStr, slideStr := sizes, sizes
+		if kind == "sliding" {
+			if sizeStr, slideStr, ok = strings.Cut(sizes, "/"); !ok {
+				slog.Warn("Ignoring sliding window without slide", "entry", entry)
+				continue
+			}
+		} else if kind != "tumbling" {
+			slog.Warn("Ignoring stream window of unknown kind", "entry", entry)
+			continue
+		}
+
+		size, err := time.ParseDuration(sizeStr)
+		if err != nil || size <= 0 {
+			slog.Warn("Ignoring stream window with invalid size", "entry", entry)
+			continue
+		}
+		slide, err := time.ParseDuration(slideStr)
+		if err != nil || slide <= 0 || slide > size {
+			slog.Warn("Ignoring stream window with invalid slide", "entry", entry)
+			continue
+		}
+
+		specs = append(specs, WindowSpec{Size: size, Slide: slide})
 	}
+	return specs
 }
 
 func getEnv(key, fallback string) string {
@@ -55,4 +257,56 @@ func getEnv(key, fallback string) string {
 		return value
 	}
 	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return d
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("Invalid integer, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("Invalid boolean, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return b
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		slog.Warn("Invalid number, using default", "key", key, "value", value, "default", fallback)
+		return fallback
+	}
+	return f
 }
\ No newline at end of file
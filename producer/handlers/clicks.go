@@ -2,8 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"net/url"
 	"producer/kafka"
+	"producer/logging"
+	"producer/tracing"
 	"producer/utils"
 	"time"
 
@@ -11,30 +14,84 @@ import (
 	// "video-ads-backend/producer/utils"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+    EventImpression = "impression"
+    EventClick      = "click"
+    EventComplete   = "complete"
+    EventConversion = "conversion"
 )
 
 type ClickEvent struct {
+    EventType       string    `json:"event_type"`
     AdID            string    `json:"ad_id"`
+    CampaignID      string    `json:"campaign_id,omitempty"`
+    LineItemID      string    `json:"line_item_id,omitempty"`
+    UserID          string    `json:"user_id,omitempty"`
+    ClickID         string    `json:"click_id,omitempty"`
+    ExperimentID    string    `json:"experiment_id,omitempty"`
+    VariantID       string    `json:"variant_id,omitempty"`
+    Country         string    `json:"country,omitempty"`
+    Device          string    `json:"device,omitempty"`
+    Placement       string    `json:"placement,omitempty"`
+    Publisher       string    `json:"publisher,omitempty"`
     Timestamp       time.Time `json:"timestamp"`
     IP              string    `json:"ip"`
     PlaybackSeconds int       `json:"playback_seconds"`
+    UserAgent       string    `json:"user_agent,omitempty"`
+    Value           float64   `json:"value,omitempty"`
+    CorrelationID   string    `json:"correlation_id,omitempty"`
 }
 
 func HandleAdClick(c *fiber.Ctx) error {
     var input struct {
         AdID            string `json:"ad_id"`
+        CampaignID      string `json:"campaign_id"`
+        LineItemID      string `json:"line_item_id"`
+        UserID          string `json:"user_id"`
+        ExperimentID    string `json:"experiment_id"`
+        VariantID       string `json:"variant_id"`
+        Country         string `json:"country"`
+        Placement       string `json:"placement"`
+        Publisher       string `json:"publisher"`
         PlaybackSeconds int    `json:"playback_seconds"`
+        LandingURL      string `json:"landing_url"`
+        ClientTime      int64  `json:"ts"`
     }
 
     if err := c.BodyParser(&input); err != nil {
         return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
     }
 
+    var landing *url.URL
+    if input.LandingURL != "" {
+        u, err := url.Parse(input.LandingURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid landing_url"})
+        }
+        landing = u
+    }
+
     event := ClickEvent{
+        EventType:       EventClick,
         AdID:            input.AdID,
-        Timestamp:       time.Now().UTC(),
+        CampaignID:      input.CampaignID,
+        LineItemID:      input.LineItemID,
+        UserID:          input.UserID,
+        ClickID:         uuid.NewString(),
+        ExperimentID:    input.ExperimentID,
+        VariantID:       input.VariantID,
+        Country:         requestCountry(c, input.Country),
+        Device:          deviceType(c.Get(fiber.HeaderUserAgent)),
+        Placement:       input.Placement,
+        Publisher:       input.Publisher,
+        Timestamp:       clientTimestamp(input.ClientTime, time.Now().UTC()),
         IP:              c.IP(),
         PlaybackSeconds: input.PlaybackSeconds,
+        UserAgent:       c.Get(fiber.HeaderUserAgent),
+        CorrelationID:   logging.CorrelationID(c.UserContext()),
     }
 
     data, err := json.Marshal(event)
@@ -42,11 +99,21 @@ func HandleAdClick(c *fiber.Ctx) error {
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize event"})
     }
 
+    tracing.AnnotateEvent(c.UserContext(), event.EventType, event.AdID)
     cfg := utils.LoadConfig()
-    if err := kafka.PublishMessage(cfg.KafkaBroker, cfg.KafkaTopic, data); err != nil {
-        log.Printf("Failed to publish message: %v", err)
+    if err := kafka.PublishOrSpool(c.UserContext(), cfg.KafkaBroker, cfg.KafkaTopic, data); err != nil {
+        slog.ErrorContext(c.UserContext(), "Failed to publish click", "ad_id", event.AdID, "error", err)
         return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to log click"})
     }
 
-    return c.JSON(fiber.Map{"status": "click logged"})
+    response := fiber.Map{"status": "click logged", "click_id": event.ClickID}
+    if landing != nil {
+        // The landing page echoes click_id back on POST /conversions.
+        query := landing.Query()
+        query.Set("click_id", event.ClickID)
+        landing.RawQuery = query.Encode()
+        response["landing_url"] = landing.String()
+    }
+
+    return c.JSON(response)
 }
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"producer/kafka"
+	"producer/logging"
+	"producer/tracing"
+	"producer/utils"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleConversion accepts POST /conversions from advertiser landing pages or
+// server-side postbacks. The consumer attributes it to a prior click via
+// click_id, or to the user's last click or impression when click_id is absent.
+func HandleConversion(c *fiber.Ctx) error {
+	var input struct {
+		ClickID    string  `json:"click_id"`
+		AdID       string  `json:"ad_id"`
+		CampaignID string  `json:"campaign_id"`
+		UserID     string  `json:"user_id"`
+		Value      float64 `json:"value"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if input.ClickID == "" && input.UserID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "click_id or user_id is required"})
+	}
+
+	event := ClickEvent{
+		EventType:     EventConversion,
+		AdID:          input.AdID,
+		CampaignID:    input.CampaignID,
+		UserID:        input.UserID,
+		ClickID:       input.ClickID,
+		Timestamp:     time.Now().UTC(),
+		IP:            c.IP(),
+		UserAgent:     c.Get(fiber.HeaderUserAgent),
+		Value:         input.Value,
+		CorrelationID: logging.CorrelationID(c.UserContext()),
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to serialize event"})
+	}
+
+	tracing.AnnotateEvent(c.UserContext(), event.EventType, event.AdID)
+	cfg := utils.LoadConfig()
+	if err := kafka.PublishOrSpool(c.UserContext(), cfg.KafkaBroker, cfg.KafkaTopic, data); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to publish conversion", "click_id", event.ClickID, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to log conversion"})
+	}
+
+	return c.JSON(fiber.Map{"status": "conversion logged"})
+}
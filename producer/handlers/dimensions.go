@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// countryHeaders are set by the CDN or load balancer in front of the
+// producer with the client's ISO 3166 country code.
+var countryHeaders = []string{"CF-IPCountry", "CloudFront-Viewer-Country", "X-Country-Code"}
+
+// requestCountry prefers an explicit country from the client and falls back
+// to the edge geolocation headers.
+func requestCountry(c *fiber.Ctx, explicit string) string {
+	if explicit != "" {
+		return strings.ToUpper(explicit)
+	}
+	for _, header := range countryHeaders {
+		if v := c.Get(header); v != "" && v != "XX" {
+			return strings.ToUpper(v)
+		}
+	}
+	return ""
+}
+
+// deviceType classifies a user agent as bot, ctv, tablet, mobile or desktop.
+func deviceType(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return ""
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "crawler") || strings.Contains(ua, "spider"):
+		return "bot"
+	case strings.Contains(ua, "smart-tv") || strings.Contains(ua, "smarttv") || strings.Contains(ua, "roku") ||
+		strings.Contains(ua, "appletv") || strings.Contains(ua, "crkey") || strings.Contains(ua, "; aft"):
+		return "ctv"
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") ||
+		(strings.Contains(ua, "android") && !strings.Contains(ua, "mobile")):
+		return "tablet"
+	case strings.Contains(ua, "mobi") || strings.Contains(ua, "iphone"):
+		return "mobile"
+	default:
+		return "desktop"
+	}
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"producer/kafka"
+	"producer/logging"
+	"producer/tracing"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// transparentGIF is the smallest valid 1x1 transparent GIF89a.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+	0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// maxClockSkew bounds how far in the past a client supplied "ts" may be
+// before it is ignored. maxFutureSkew is far smaller: the consumer's
+// watermark, time buckets and budgets all follow event time, so one event
+// from days ahead would push every real-time event after it out of its
+// window.
+const (
+	maxClockSkew  = 7 * 24 * time.Hour
+	maxFutureSkew = 30 * time.Second
+)
+
+// HandlePixel serves GET /p.gif for image-only placements and POST /p.gif for
+// navigator.sendBeacon. The event is queued for Kafka without waiting on the
+// broker, and the response never depends on whether publishing succeeded.
+func HandlePixel(c *fiber.Ctx) error {
+	params, err := pixelParams(c)
+	if err != nil {
+		logging.Events().WarnContext(c.UserContext(), "Failed to decode pixel request", "error", err)
+	} else if event, ok := pixelEvent(c, params); ok {
+		tracing.AnnotateEvent(c.UserContext(), event.EventType, event.AdID)
+		if data, err := json.Marshal(event); err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to serialize pixel event", "error", err)
+		} else if !kafka.PublishAsync(c.UserContext(), data) {
+			slog.WarnContext(c.UserContext(), "Pixel queue full, dropping event", "event_type", event.EventType, "ad_id", event.AdID)
+		}
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store, no-cache, must-revalidate, max-age=0")
+	c.Set(fiber.HeaderPragma, "no-cache")
+	c.Set(fiber.HeaderExpires, "0")
+
+	if c.Method() == fiber.MethodPost {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	c.Set(fiber.HeaderContentType, "image/gif")
+	return c.Send(transparentGIF)
+}
+
+// pixelParams merges the query string with a beacon body. sendBeacon posts
+// either a JSON string (text/plain) or URL encoded form data, so both are
+// accepted regardless of the declared content type.
+func pixelParams(c *fiber.Ctx) (url.Values, error) {
+	params, err := url.ParseQuery(string(c.Request().URI().QueryString()))
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.TrimSpace(c.Body())
+	if c.Method() != fiber.MethodPost || len(body) == 0 {
+		return params, nil
+	}
+
+	if body[0] == '{' {
+		var fields map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, err
+		}
+		for key, value := range fields {
+			params.Set(key, fmt.Sprint(value))
+		}
+		return params, nil
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range form {
+		params[key] = values
+	}
+	return params, nil
+}
+
+func pixelEvent(c *fiber.Ctx, params url.Values) (ClickEvent, bool) {
+	event := ClickEvent{
+		EventType:     params.Get("event"),
+		AdID:          params.Get("ad_id"),
+		CampaignID:    params.Get("campaign_id"),
+		LineItemID:    params.Get("line_item_id"),
+		UserID:        params.Get("user_id"),
+		ExperimentID:  params.Get("experiment_id"),
+		VariantID:     params.Get("variant_id"),
+		Country:       requestCountry(c, params.Get("country")),
+		Device:        deviceType(c.Get(fiber.HeaderUserAgent)),
+		Placement:     params.Get("placement"),
+		Publisher:     params.Get("publisher"),
+		Timestamp:     time.Now().UTC(),
+		IP:            c.IP(),
+		UserAgent:     c.Get(fiber.HeaderUserAgent),
+		CorrelationID: logging.CorrelationID(c.UserContext()),
+	}
+
+	if event.AdID == "" {
+		return event, false
+	}
+
+	switch event.EventType {
+	case "":
+		event.EventType = EventImpression
+	case EventImpression, EventClick, EventComplete:
+	default:
+		return event, false
+	}
+
+	if seconds, err := strconv.Atoi(params.Get("playback_seconds")); err == nil && seconds > 0 {
+		event.PlaybackSeconds = seconds
+	}
+
+	if ms, err := strconv.ParseInt(params.Get("ts"), 10, 64); err == nil {
+		event.Timestamp = clientTimestamp(ms, event.Timestamp)
+	}
+
+	return event, true
+}
+
+// clientTimestamp returns the client supplied event time in Unix
+// milliseconds, so delayed uploads keep their real event time, or fallback
+// when it is unset or implausibly far from server time.
+func clientTimestamp(ms int64, fallback time.Time) time.Time {
+	if ms <= 0 {
+		return fallback
+	}
+	ts := time.UnixMilli(ms).UTC()
+	if skew := time.Since(ts); skew >= maxClockSkew || skew <= -maxFutureSkew {
+		return fallback
+	}
+	return ts
+}
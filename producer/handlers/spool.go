@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"producer/kafka"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetSpool reports how many messages are waiting in the local spool for
+// Kafka to come back.
+func GetSpool(c *fiber.Ctx) error {
+	return c.JSON(kafka.CurrentSpool())
+}
@@ -0,0 +1,139 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"producer/metrics"
+	"producer/tracing"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	asyncBatchSize    = 100
+	asyncWriteTimeout = 10 * time.Second
+)
+
+var (
+	asyncQueue chan kafka.Message
+	asyncDone  chan struct{}
+
+	// asyncMu guards closing asyncQueue against concurrent PublishAsync calls.
+	asyncMu     sync.RWMutex
+	asyncClosed bool
+)
+
+// StartAsyncPublisher starts a background writer that drains messages queued
+// with PublishAsync. Unlike PublishMessage it keeps one long-lived writer, so
+// request handlers never wait on the broker.
+func StartAsyncPublisher(broker, topic string, queueSize int) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(broker),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		BatchTimeout: 50 * time.Millisecond,
+	}
+
+	asyncQueue = make(chan kafka.Message, queueSize)
+	asyncDone = make(chan struct{})
+	metrics.WatchQueue(func() int { return len(asyncQueue) }, queueSize)
+	go func() {
+		defer close(asyncDone)
+		runAsyncPublisher(writer, asyncQueue)
+	}()
+}
+
+// StopAsyncPublisher stops accepting messages and waits until everything
+// already queued has been written and the writer closed, or ctx is done.
+// Messages published afterwards are dropped.
+func StopAsyncPublisher(ctx context.Context) error {
+	asyncMu.Lock()
+	if asyncQueue == nil || asyncClosed {
+		asyncMu.Unlock()
+		return nil
+	}
+	asyncClosed = true
+	close(asyncQueue)
+	asyncMu.Unlock()
+
+	select {
+	case <-asyncDone:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued messages not flushed: %w", len(asyncQueue), ctx.Err())
+	}
+}
+
+// PublishAsync queues a message for the background writer. It never blocks and
+// reports false when the queue is full or the publisher was not started. The
+// producer span covers only the enqueue, since the write happens later in a
+// batch shared with other traces.
+func PublishAsync(ctx context.Context, message []byte) bool {
+	asyncMu.RLock()
+	defer asyncMu.RUnlock()
+	if asyncQueue == nil || asyncClosed {
+		return false
+	}
+
+	ctx, span := tracing.Tracer().Start(ctx, "enqueue", trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	msg := kafka.Message{Value: message}
+	tracing.Inject(ctx, &msg)
+
+	select {
+	case asyncQueue <- msg:
+		return true
+	default:
+		metrics.AsyncDropped.Inc()
+		return false
+	}
+}
+
+func runAsyncPublisher(writer *kafka.Writer, queue chan kafka.Message) {
+	defer writer.Close()
+
+	batch := make([]kafka.Message, 0, asyncBatchSize)
+	for message := range queue {
+		batch = append(batch, message)
+
+	fill:
+		for len(batch) < asyncBatchSize {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+
+		// While the spool holds messages Kafka is likely still down, and
+		// waiting out a write timeout per batch would fill the queue.
+		s := activeSpool
+		if s != nil && s.depth() > 0 {
+			s.appendAsync(batch)
+			batch = batch[:0]
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), asyncWriteTimeout)
+		start := time.Now()
+		err := writer.WriteMessages(ctx, batch...)
+		metrics.ObserveKafkaWrite("async", len(batch), start, err)
+		cancel()
+		if err != nil && s != nil {
+			slog.Warn("Kafka unavailable, spooling async messages", "messages", len(batch), "error", err)
+			s.appendAsync(batch)
+		} else if err != nil {
+			slog.Error("Failed to write async messages to Kafka", "messages", len(batch), "error", err)
+		}
+
+		batch = batch[:0]
+	}
+}
@@ -0,0 +1,30 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// PingBroker dials the broker and reads the topic's partitions, which fails
+// if the broker is down or the topic is missing.
+func PingBroker(ctx context.Context, broker, topic string) error {
+	conn, err := kafka.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	partitions, err := conn.ReadPartitions(topic)
+	if err != nil {
+		return fmt.Errorf("failed to read partitions of %s: %w", topic, err)
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", topic)
+	}
+	return nil
+}
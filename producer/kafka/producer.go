@@ -2,13 +2,16 @@ package kafka
 
 import (
     "context"
-    "log"
+    "log/slog"
+    "producer/metrics"
+    "producer/tracing"
     "time"
 
     "github.com/segmentio/kafka-go"
+    "go.opentelemetry.io/otel/trace"
 )
 
-func PublishMessage(broker, topic string, message []byte) error {
+func PublishMessage(ctx context.Context, broker, topic string, message []byte) error {
     writer := &kafka.Writer{
         Addr:     kafka.TCP(broker),
         Topic:    topic,
@@ -16,14 +19,23 @@ func PublishMessage(broker, topic string, message []byte) error {
     }
     defer writer.Close()
 
-    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    ctx, span := tracing.Tracer().Start(ctx, "publish "+topic, trace.WithSpanKind(trace.SpanKindProducer))
+    var err error
+    defer func() { tracing.End(span, err) }()
+
+    ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
     defer cancel()
 
-    err := writer.WriteMessages(ctx, kafka.Message{
+    msg := kafka.Message{
         Value: message,
-    })
+    }
+    tracing.Inject(ctx, &msg)
+
+    start := time.Now()
+    err = writer.WriteMessages(ctx, msg)
+    metrics.ObserveKafkaWrite("sync", 1, start, err)
     if err != nil {
-        log.Printf("Failed to write message to Kafka: %v", err)
+        slog.ErrorContext(ctx, "Failed to write message to Kafka", "topic", topic, "error", err)
     }
     return err
 }
\ No newline at end of file
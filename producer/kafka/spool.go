@@ -0,0 +1,643 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"producer/metrics"
+	"producer/tracing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	spoolSegmentBytes = 16 << 20
+	spoolBatchSize    = 500
+	spoolCursorFile   = "cursor"
+	spoolSuffix       = ".wal"
+
+	// spoolHeaderSize is the length and CRC-32C that precede every record.
+	spoolHeaderSize = 8
+)
+
+// ErrSpoolFull is returned when appending would take the spool past its
+// size limit.
+var ErrSpoolFull = errors.New("spool is full")
+
+var spoolTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SpoolStats describes what the spool holds.
+type SpoolStats struct {
+	Enabled  bool  `json:"enabled"`
+	Messages int64 `json:"messages"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+	Segments int   `json:"segments"`
+}
+
+// Accepting reports whether the spool can take messages Kafka refuses.
+func (s SpoolStats) Accepting() bool {
+	return s.Enabled && s.Bytes < s.MaxBytes
+}
+
+type spoolSegment struct {
+	name    string
+	size    int64
+	records int64
+}
+
+// spool is an append-only log of messages Kafka did not accept, split into
+// segment files that are deleted once every record in them is published.
+// Only the active segment is written; the drainer reads sealed ones, so it
+// needs the lock only to pick a segment and account for what it published.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	sealed   []spoolSegment
+	active   *os.File
+	current  spoolSegment
+	nextSeq  uint64
+	bytes    int64
+	messages int64
+}
+
+var (
+	activeSpool *spool
+	spoolStop   context.CancelFunc
+	spoolDone   chan struct{}
+)
+
+// StartSpool opens the spool in dir, creating it if needed, and starts
+// draining anything it holds to Kafka every interval. Messages left by a
+// previous run are published before any new ones. Until it is started,
+// PublishOrSpool only publishes.
+func StartSpool(dir string, maxBytes int64, broker, topic string, interval time.Duration) error {
+	s, err := openSpool(dir, maxBytes)
+	if err != nil {
+		return err
+	}
+	if s.messages > 0 {
+		slog.Warn("Spool holds messages from a previous run", "messages", s.messages, "bytes", s.bytes)
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(broker),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		BatchSize:    spoolBatchSize,
+		BatchTimeout: 50 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	activeSpool = s
+	spoolStop = cancel
+	spoolDone = make(chan struct{})
+	metrics.WatchSpool(s.depth, s.size, maxBytes)
+	go func() {
+		defer close(spoolDone)
+		defer writer.Close()
+		s.run(ctx, writer, interval)
+	}()
+	return nil
+}
+
+// StopSpool stops draining and closes the active segment. Whatever has not
+// been published stays on disk for the next start.
+func StopSpool(ctx context.Context) error {
+	if activeSpool == nil {
+		return nil
+	}
+	spoolStop()
+	select {
+	case <-spoolDone:
+	case <-ctx.Done():
+		return fmt.Errorf("spool drain did not stop: %w", ctx.Err())
+	}
+	return activeSpool.close()
+}
+
+// PublishOrSpool writes message to Kafka and, if that fails, appends it to
+// the spool so it is published once the broker is back. While the spool
+// holds messages new ones go straight behind them, without waiting on a
+// broker that is likely still down, so the drain keeps them in order. It
+// returns an error only if the message is neither published nor spooled.
+// Spooled messages carry the trace context of ctx.
+func PublishOrSpool(ctx context.Context, broker, topic string, message []byte) error {
+	s := activeSpool
+	if s == nil {
+		return PublishMessage(ctx, broker, topic, message)
+	}
+
+	if s.depth() == 0 {
+		err := PublishMessage(ctx, broker, topic, message)
+		if err == nil {
+			return nil
+		}
+		slog.WarnContext(ctx, "Kafka unavailable, spooling message", "error", err)
+	}
+	msg := kafka.Message{Value: message}
+	tracing.Inject(ctx, &msg)
+	if err := s.append(msg); err != nil {
+		if err == ErrSpoolFull {
+			metrics.SpoolRejected.Inc()
+		}
+		return fmt.Errorf("failed to spool message: %w", err)
+	}
+	metrics.SpoolAppended.Inc()
+	return nil
+}
+
+// appendAsync spools a batch the async publisher could not write. A batch
+// the spool refuses is dropped, as it was before the spool existed.
+func (s *spool) appendAsync(batch []kafka.Message) {
+	if err := s.append(batch...); err != nil {
+		if err == ErrSpoolFull {
+			metrics.SpoolRejected.Add(float64(len(batch)))
+		}
+		slog.Error("Failed to spool async messages", "messages", len(batch), "error", err)
+		return
+	}
+	metrics.SpoolAppended.Add(float64(len(batch)))
+}
+
+// CurrentSpool reports the spool's contents, or a disabled spool if it was
+// not started.
+func CurrentSpool() SpoolStats {
+	s := activeSpool
+	if s == nil {
+		return SpoolStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	segments := len(s.sealed)
+	if s.active != nil {
+		segments++
+	}
+	return SpoolStats{
+		Enabled:  true,
+		Messages: s.messages,
+		Bytes:    s.bytes,
+		MaxBytes: s.maxBytes,
+		Segments: segments,
+	}
+}
+
+// openSpool loads the segments in dir, skipping the records the cursor
+// marks as already published and any torn record at the end of a segment.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool directory: %w", err)
+	}
+
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	cursorSegment, cursorOffset := s.readCursor()
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), spoolSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		if seq >= s.nextSeq {
+			s.nextSeq = seq + 1
+		}
+
+		var offset int64
+		if name == cursorSegment {
+			offset = cursorOffset
+		}
+		seg, err := scanSegment(filepath.Join(dir, name), offset)
+		if err != nil {
+			return nil, err
+		}
+		seg.name = name
+		s.sealed = append(s.sealed, seg)
+		s.bytes += seg.size
+		s.messages += seg.records
+	}
+	return s, nil
+}
+
+func scanSegment(path string, offset int64) (spoolSegment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return spoolSegment{}, fmt.Errorf("failed to open spool segment: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return spoolSegment{}, err
+	}
+	seg := spoolSegment{size: info.Size()}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return seg, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		if _, err := readRecord(r); err != nil {
+			return seg, nil
+		}
+		seg.records++
+	}
+}
+
+// append writes the messages to the active segment with a single write and
+// sync. Either all of them are spooled or, if it returns an error, none is
+// counted as spooled.
+func (s *spool) append(messages ...kafka.Message) error {
+	var records []byte
+	for _, m := range messages {
+		records = appendRecord(records, encodeSpoolMessage(m))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bytes+int64(len(records)) > s.maxBytes {
+		return ErrSpoolFull
+	}
+	if s.active == nil {
+		name := fmt.Sprintf("%020d%s", s.nextSeq, spoolSuffix)
+		f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		// Syncing the file alone does not persist its directory entry.
+		if err := syncDir(s.dir); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return err
+		}
+		s.nextSeq++
+		s.active = f
+		s.current = spoolSegment{name: name}
+	}
+
+	// The client is acknowledged once this returns, so the records must
+	// survive a crash. After a failed write the segment may end in a torn
+	// record, which would hide any appended after it, so a new one is
+	// started.
+	_, err := s.active.Write(records)
+	if err == nil {
+		err = s.active.Sync()
+	}
+	if err != nil {
+		s.seal()
+		return err
+	}
+	s.current.size += int64(len(records))
+	s.current.records += int64(len(messages))
+	s.bytes += int64(len(records))
+	s.messages += int64(len(messages))
+
+	if s.current.size >= spoolSegmentBytes {
+		return s.seal()
+	}
+	return nil
+}
+
+// seal closes the active segment and queues it for draining. s.mu must be
+// held.
+func (s *spool) seal() error {
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.sealed = append(s.sealed, s.current)
+	s.active = nil
+	s.current = spoolSegment{}
+	return err
+}
+
+func (s *spool) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seal()
+}
+
+func (s *spool) depth() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.messages
+}
+
+func (s *spool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes
+}
+
+func (s *spool) run(ctx context.Context, writer *kafka.Writer, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		err := s.drain(ctx, writer)
+		if ctx.Err() != nil {
+			return
+		}
+		// Log only when draining starts or stops failing; the broker may be
+		// down for a while and this runs every interval.
+		if err != nil && !failing {
+			slog.Warn("Failed to drain spool, will retry", "messages", s.depth(), "error", err)
+		} else if err == nil && failing {
+			slog.Info("Spool drained to Kafka")
+		}
+		failing = err != nil
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes segments oldest first until the spool is empty or a
+// write fails. Progress is recorded after every batch, so a crash resends
+// at most one batch.
+func (s *spool) drain(ctx context.Context, writer *kafka.Writer) error {
+	for {
+		seg, offset, ok := s.head()
+		if !ok {
+			return nil
+		}
+		if err := s.drainSegment(ctx, writer, seg, offset); err != nil {
+			return err
+		}
+		if err := s.remove(seg); err != nil {
+			return err
+		}
+	}
+}
+
+// head returns the oldest segment and where draining it should resume,
+// sealing the active segment if nothing older is left.
+func (s *spool) head() (spoolSegment, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sealed) == 0 {
+		if s.active == nil {
+			return spoolSegment{}, 0, false
+		}
+		if err := s.seal(); err != nil {
+			slog.Error("Failed to seal spool segment", "segment", s.sealed[0].name, "error", err)
+		}
+	}
+	seg := s.sealed[0]
+	name, offset := s.readCursor()
+	if name != seg.name {
+		offset = 0
+	}
+	return seg, offset, true
+}
+
+func (s *spool) drainSegment(ctx context.Context, writer *kafka.Writer, seg spoolSegment, offset int64) error {
+	f, err := os.Open(filepath.Join(s.dir, seg.name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+
+	batch := make([]kafka.Message, 0, spoolBatchSize)
+	for {
+		batch = batch[:0]
+		read := offset
+		var readErr error
+		for len(batch) < spoolBatchSize {
+			payload, err := readRecord(r)
+			if err == nil {
+				var message kafka.Message
+				if message, err = decodeSpoolMessage(payload); err == nil {
+					batch = append(batch, message)
+					read += int64(spoolHeaderSize + len(payload))
+					continue
+				}
+			}
+			readErr = err
+			break
+		}
+
+		if len(batch) > 0 {
+			writeCtx, cancel := context.WithTimeout(ctx, asyncWriteTimeout)
+			start := time.Now()
+			err := writer.WriteMessages(writeCtx, batch...)
+			cancel()
+			metrics.ObserveKafkaWrite("spool", len(batch), start, err)
+			if err != nil {
+				return err
+			}
+			offset = read
+			if err := s.commit(seg.name, offset, int64(len(batch))); err != nil {
+				return err
+			}
+			metrics.SpoolDrained.Add(float64(len(batch)))
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			// A torn or corrupt record can only be followed by more of the
+			// same write, so the rest of the segment is dropped.
+			slog.Error("Dropping unreadable spool records", "segment", seg.name, "offset", offset, "error", readErr)
+			metrics.SpoolCorrupt.Inc()
+			return nil
+		}
+	}
+}
+
+// commit records that the segment has been published up to offset. The
+// cursor is synced before it replaces the old one and the rename is synced
+// after, so a crash leaves either cursor whole.
+func (s *spool) commit(name string, offset, published int64) error {
+	tmp := filepath.Join(s.dir, spoolCursorFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %d\n", name, offset)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, spoolCursorFile)); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.messages -= published
+	s.sealed[0].records -= published
+	s.mu.Unlock()
+	return nil
+}
+
+// remove deletes a fully published segment, dropping any records left
+// unreadable in it from the depth.
+func (s *spool) remove(seg spoolSegment) error {
+	if err := os.Remove(filepath.Join(s.dir, seg.name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(filepath.Join(s.dir, spoolCursorFile))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bytes -= s.sealed[0].size
+	s.messages -= s.sealed[0].records
+	s.sealed = s.sealed[1:]
+	return nil
+}
+
+func (s *spool) readCursor() (string, int64) {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		return "", 0
+	}
+	name, offset, ok := strings.Cut(strings.TrimSpace(string(data)), " ")
+	if !ok {
+		return "", 0
+	}
+	n, err := strconv.ParseInt(offset, 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return name, n
+}
+
+// appendRecord frames payload with its length and checksum and appends it
+// to dst.
+func appendRecord(dst, payload []byte) []byte {
+	var header [spoolHeaderSize]byte
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:8], crc32.Checksum(payload, spoolTable))
+	return append(append(dst, header[:]...), payload...)
+}
+
+// encodeSpoolMessage lays out a message's key, headers and value as one
+// record payload, so the drain publishes it as it was written. Key and
+// headers are length prefixed; the value takes the rest of the payload.
+func encodeSpoolMessage(m kafka.Message) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(m.Key)))
+	b = append(b, m.Key...)
+	b = binary.AppendUvarint(b, uint64(len(m.Headers)))
+	for _, h := range m.Headers {
+		b = binary.AppendUvarint(b, uint64(len(h.Key)))
+		b = append(b, h.Key...)
+		b = binary.AppendUvarint(b, uint64(len(h.Value)))
+		b = append(b, h.Value...)
+	}
+	return append(b, m.Value...)
+}
+
+func decodeSpoolMessage(payload []byte) (kafka.Message, error) {
+	next := func() ([]byte, error) {
+		n, size := binary.Uvarint(payload)
+		if size <= 0 || n > uint64(len(payload)-size) {
+			return nil, fmt.Errorf("malformed spool record")
+		}
+		field := payload[size : size+int(n)]
+		payload = payload[size+int(n):]
+		return field, nil
+	}
+
+	var m kafka.Message
+	key, err := next()
+	if err != nil {
+		return m, err
+	}
+	if len(key) > 0 {
+		m.Key = key
+	}
+	count, size := binary.Uvarint(payload)
+	if size <= 0 {
+		return m, fmt.Errorf("malformed spool record")
+	}
+	payload = payload[size:]
+	for i := uint64(0); i < count; i++ {
+		k, err := next()
+		if err != nil {
+			return m, err
+		}
+		v, err := next()
+		if err != nil {
+			return m, err
+		}
+		m.Headers = append(m.Headers, kafka.Header{Key: string(k), Value: v})
+	}
+	m.Value = payload
+	return m, nil
+}
+
+// readRecord reads one record, returning io.EOF at a clean end of segment
+// and another error for a torn or corrupt record.
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	var header [spoolHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated record header")
+		}
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > spoolSegmentBytes {
+		return nil, fmt.Errorf("record length %d out of range", length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("truncated record: %w", err)
+	}
+	if crc32.Checksum(value, spoolTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, fmt.Errorf("record checksum mismatch")
+	}
+	return value, nil
+}
+
+// syncDir flushes dir's entries, making files created or renamed in it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
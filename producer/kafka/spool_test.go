@@ -0,0 +1,217 @@
+package kafka
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64) *spool {
+	t.Helper()
+	s, err := openSpool(dir, maxBytes)
+	if err != nil {
+		t.Fatalf("openSpool: %v", err)
+	}
+	return s
+}
+
+func appendAll(t *testing.T, s *spool, messages ...string) {
+	t.Helper()
+	for _, m := range messages {
+		if err := s.append(kafka.Message{Value: []byte(m)}); err != nil {
+			t.Fatalf("append %q: %v", m, err)
+		}
+	}
+}
+
+// pending returns the values of the messages left in the head segment,
+// where draining would resume, and the error that stopped reading it.
+func pending(t *testing.T, s *spool) ([]string, error) {
+	t.Helper()
+	messages, err := pendingMessages(t, s)
+	values := make([]string, len(messages))
+	for i, m := range messages {
+		values[i] = string(m.Value)
+	}
+	return values, err
+}
+
+func pendingMessages(t *testing.T, s *spool) ([]kafka.Message, error) {
+	t.Helper()
+	seg, offset, ok := s.head()
+	if !ok {
+		return nil, io.EOF
+	}
+	f, err := os.Open(filepath.Join(s.dir, seg.name))
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatalf("seek segment: %v", err)
+	}
+
+	r := bufio.NewReader(f)
+	var messages []kafka.Message
+	for {
+		payload, err := readRecord(r)
+		if err != nil {
+			return messages, err
+		}
+		m, err := decodeSpoolMessage(payload)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, m)
+	}
+}
+
+func assertMessages(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got messages %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got messages %q, want %q", got, want)
+		}
+	}
+}
+
+func TestSpoolReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<20)
+	appendAll(t, s, "a", "bb", "ccc")
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s = openTestSpool(t, dir, 1<<20)
+	if got := s.depth(); got != 3 {
+		t.Fatalf("depth = %d, want 3", got)
+	}
+	// Each payload has a zero key length and header count before the value.
+	if got, want := s.size(), int64(3*(spoolHeaderSize+2)+6); got != want {
+		t.Fatalf("size = %d, want %d", got, want)
+	}
+	got, err := pending(t, s)
+	if err != io.EOF {
+		t.Fatalf("read error = %v, want EOF", err)
+	}
+	assertMessages(t, got, "a", "bb", "ccc")
+}
+
+func TestSpoolResumesFromCursor(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<20)
+	appendAll(t, s, "a", "bb", "ccc")
+
+	seg, _, ok := s.head()
+	if !ok {
+		t.Fatal("head: spool is empty")
+	}
+	first := int64(len(appendRecord(nil, encodeSpoolMessage(kafka.Message{Value: []byte("a")}))))
+	if err := s.commit(seg.name, first, 1); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s = openTestSpool(t, dir, 1<<20)
+	if got := s.depth(); got != 2 {
+		t.Fatalf("depth = %d, want 2", got)
+	}
+	got, err := pending(t, s)
+	if err != io.EOF {
+		t.Fatalf("read error = %v, want EOF", err)
+	}
+	assertMessages(t, got, "bb", "ccc")
+}
+
+func TestSpoolSkipsTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<20)
+	appendAll(t, s, "a", "bb")
+	name := s.current.name
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	// A crash mid-write leaves a header whose record was never finished.
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0, 9, 1, 2, 3, 4, 'x'}); err != nil {
+		t.Fatalf("write torn record: %v", err)
+	}
+	f.Close()
+
+	s = openTestSpool(t, dir, 1<<20)
+	if got := s.depth(); got != 2 {
+		t.Fatalf("depth = %d, want 2", got)
+	}
+	got, err := pending(t, s)
+	if err == nil || err == io.EOF {
+		t.Fatalf("read error = %v, want a torn record", err)
+	}
+	assertMessages(t, got, "a", "bb")
+
+	// Appends after reopening go to a new segment, not after the torn one.
+	appendAll(t, s, "ccc")
+	if s.current.name == name {
+		t.Fatalf("append reused torn segment %s", name)
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 2*(spoolHeaderSize+4))
+	appendAll(t, s, "aa", "bb")
+
+	if err := s.append(kafka.Message{Value: []byte("c")}); !errors.Is(err, ErrSpoolFull) {
+		t.Fatalf("append past limit = %v, want ErrSpoolFull", err)
+	}
+	if got := s.depth(); got != 2 {
+		t.Fatalf("depth = %d, want 2", got)
+	}
+}
+
+func TestSpoolKeepsKeyAndHeaders(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 1<<20)
+	batch := []kafka.Message{
+		{Key: []byte("ad-1"), Value: []byte("a"), Headers: []kafka.Header{{Key: "traceparent", Value: []byte("00-abc-def-01")}}},
+		{Value: []byte("b")},
+	}
+	if err := s.append(batch...); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	s = openTestSpool(t, dir, 1<<20)
+	got, err := pendingMessages(t, s)
+	if err != io.EOF {
+		t.Fatalf("read error = %v, want EOF", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d messages, want 2", len(got))
+	}
+	first := got[0]
+	if string(first.Key) != "ad-1" || string(first.Value) != "a" {
+		t.Fatalf("first message = %q/%q, want ad-1/a", first.Key, first.Value)
+	}
+	if len(first.Headers) != 1 || first.Headers[0].Key != "traceparent" || string(first.Headers[0].Value) != "00-abc-def-01" {
+		t.Fatalf("first message headers = %v", first.Headers)
+	}
+	if got[1].Key != nil || len(got[1].Headers) != 0 || string(got[1].Value) != "b" {
+		t.Fatalf("second message = %+v, want value b only", got[1])
+	}
+}
@@ -47,9 +47,18 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
 	"producer/handlers"
+	"producer/health"
+	"producer/kafka"
+	"producer/logging"
+	"producer/metrics"
+	"producer/tracing"
 	"producer/utils"
+	"syscall"
 
 	// "video-ads-backend/producer/handlers"
 	// "video-ads-backend/producer/utils"
@@ -59,11 +68,87 @@ import (
 
 func main() {
     cfg := utils.LoadConfig()
+    logging.Init(cfg.LogLevel, cfg.LogSampleEvery)
+
+    shutdownTracing, err := tracing.Init(cfg.TraceExporter, cfg.TraceSampleRatio)
+    if err != nil {
+        slog.Error("Failed to initialize tracing", "error", err)
+        os.Exit(1)
+    }
+
     app := fiber.New()
+    app.Use(metrics.Middleware())
+    app.Use(logging.Middleware())
+    app.Use(tracing.Middleware())
+
+    // The spool starts first so the async publisher can fall back to it.
+    if cfg.SpoolDir != "" {
+        if err := kafka.StartSpool(cfg.SpoolDir, cfg.SpoolMaxBytes, cfg.KafkaBroker, cfg.KafkaTopic, cfg.SpoolDrainInterval); err != nil {
+            slog.Error("Failed to open spool", "dir", cfg.SpoolDir, "error", err)
+            os.Exit(1)
+        }
+    }
+    kafka.StartAsyncPublisher(cfg.KafkaBroker, cfg.KafkaTopic, cfg.PixelQueueSize)
 
     // app.Get("/ads", handlers.GetAds)
     app.Post("/ads/click", handlers.HandleAdClick)
+    app.Post("/conversions", handlers.HandleConversion)
+    app.Get("/p.gif", handlers.HandlePixel)
+    app.Post("/p.gif", handlers.HandlePixel)
+    app.Get("/metrics", metrics.Handler())
+    app.Get("/healthz", health.Live())
+    app.Get("/readyz", health.Ready(cfg.ReadyTimeout, map[string]health.Check{
+        // While the spool can absorb events a Kafka outage loses nothing,
+        // so the producer stays in rotation and reports it as degraded.
+        "kafka": func(ctx context.Context) error {
+            err := kafka.PingBroker(ctx, cfg.KafkaBroker, cfg.KafkaTopic)
+            if kafka.CurrentSpool().Accepting() {
+                return health.Degraded(err)
+            }
+            return err
+        },
+    }))
+    app.Get("/admin/spool", handlers.GetSpool)
+    app.Get("/admin/log-level", logging.LevelHandler())
+    app.Put("/admin/log-level", logging.LevelHandler())
+
+    signals, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
+
+    serverDone := make(chan error, 1)
+    go func() {
+        slog.Info("Producer service running", "port", cfg.ProducerPort)
+        serverDone <- app.Listen(":" + cfg.ProducerPort)
+    }()
+
+    exitCode := 0
+    select {
+    case <-signals.Done():
+        slog.Info("Received shutdown signal, stopping producer")
+    case err := <-serverDone:
+        slog.Error("Producer server failed", "error", err)
+        exitCode = 1
+    }
+    stop()
 
-    log.Printf("Producer service running on port %s", cfg.ProducerPort)
-    log.Fatal(app.Listen(":" + cfg.ProducerPort))
+    // Stop accepting requests first so nothing is queued after the async
+    // publisher's final flush.
+    ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+    defer cancel()
+    if err := app.ShutdownWithContext(ctx); err != nil {
+        slog.Error("HTTP server shutdown failed", "error", err)
+    }
+    if err := kafka.StopAsyncPublisher(ctx); err != nil {
+        slog.Error("Failed to flush async Kafka messages", "error", err)
+    }
+    if err := kafka.StopSpool(ctx); err != nil {
+        slog.Error("Failed to close spool", "error", err)
+    }
+    if err := shutdownTracing(ctx); err != nil {
+        slog.Error("Tracing shutdown failed", "error", err)
+    }
+    slog.Info("Producer service stopped")
+    if exitCode != 0 {
+        os.Exit(exitCode)
+    }
 }
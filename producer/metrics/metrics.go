@@ -0,0 +1,140 @@
+// Package metrics defines the producer's Prometheus metrics and the handlers
+// that record and expose them.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// KafkaPublished counts messages handed to Kafka. mode is "sync" for
+	// PublishMessage and "async" for the background publisher; result is
+	// "success" or "failure".
+	KafkaPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kafka_publish_messages_total",
+		Help: "Messages published to Kafka by mode and result.",
+	}, []string{"mode", "result"})
+
+	// KafkaPublishDuration times each write call, which is one message in
+	// sync mode and one batch in async mode.
+	KafkaPublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kafka_publish_duration_seconds",
+		Help:    "Kafka write latency by mode.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"mode"})
+
+	// AsyncDropped counts messages rejected because the async queue was full.
+	AsyncDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "kafka_async_dropped_total",
+		Help: "Messages dropped because the async publish queue was full.",
+	})
+
+	// SpoolAppended counts messages written to the local spool because Kafka
+	// was unavailable or the spool was already draining.
+	SpoolAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_appended_messages_total",
+		Help: "Messages appended to the local spool.",
+	})
+
+	// SpoolDrained counts spooled messages published to Kafka.
+	SpoolDrained = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_drained_messages_total",
+		Help: "Spooled messages published to Kafka.",
+	})
+
+	// SpoolRejected counts messages refused because the spool was full.
+	SpoolRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_rejected_messages_total",
+		Help: "Messages rejected because the spool reached its size limit.",
+	})
+
+	// SpoolCorrupt counts segments whose tail was dropped as unreadable.
+	SpoolCorrupt = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "spool_corrupt_segments_total",
+		Help: "Spool segments with torn or corrupt records.",
+	})
+)
+
+// ObserveKafkaWrite records one Kafka write of n messages.
+func ObserveKafkaWrite(mode string, n int, start time.Time, err error) {
+	KafkaPublishDuration.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	KafkaPublished.WithLabelValues(mode, result).Add(float64(n))
+}
+
+// WatchQueue exports the length and capacity of the async publish queue.
+func WatchQueue(length func() int, capacity int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kafka_async_queue_length",
+		Help: "Messages waiting in the async publish queue.",
+	}, func() float64 { return float64(length()) })
+	promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kafka_async_queue_capacity",
+		Help: "Capacity of the async publish queue.",
+	}).Set(float64(capacity))
+}
+
+// WatchSpool exports the number of messages and bytes waiting in the spool
+// and its size limit.
+func WatchSpool(depth func() int64, size func() int64, capacity int64) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "spool_depth_messages",
+		Help: "Messages waiting in the spool to be published.",
+	}, func() float64 { return float64(depth()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "spool_size_bytes",
+		Help: "Bytes used by spool segments on disk.",
+	}, func() float64 { return float64(size()) })
+	promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_capacity_bytes",
+		Help: "Size limit of the spool.",
+	}).Set(float64(capacity))
+}
+
+// Middleware records the rate and latency of every request, labelled with
+// the matched route pattern rather than the raw path to bound cardinality.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			if e, ok := err.(*fiber.Error); ok {
+				status = e.Code
+			}
+		}
+		route := c.Route().Path
+		method := c.Method()
+		httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// Handler serves the registry in the Prometheus text format.
+func Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.Handler())
+}
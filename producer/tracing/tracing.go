@@ -0,0 +1,146 @@
+// Package tracing configures OpenTelemetry for the producer and carries
+// trace context across Kafka in message headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "producer"
+
+// Init installs the global tracer provider and W3C propagator. exporter is
+// "otlp" (configured by the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout", or "none" to keep tracing disabled. The returned function
+// flushes buffered spans.
+func Init(exporter string, sampleRatio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exp, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", exporter, "sample_ratio", sampleRatio)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the producer's tracer from the global provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// HeaderCarrier adapts Kafka message headers to the propagation API.
+type HeaderCarrier struct {
+	Headers *[]kafka.Header
+}
+
+func (c HeaderCarrier) Get(key string) string {
+	for _, h := range *c.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func (c HeaderCarrier) Set(key, value string) {
+	for i, h := range *c.Headers {
+		if h.Key == key {
+			(*c.Headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*c.Headers = append(*c.Headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, len(*c.Headers))
+	for i, h := range *c.Headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
+
+// Inject writes the trace context of ctx into the message headers.
+func Inject(ctx context.Context, message *kafka.Message) {
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier{Headers: &message.Headers})
+}
+
+// Middleware starts a server span per request, continuing any trace context
+// sent by the client, and stores it in the request's user context so
+// handlers can pass it on to Kafka.
+func Middleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), propagation.HeaderCarrier(http.Header(c.GetReqHeaders())))
+		ctx, span := Tracer().Start(ctx, c.Method()+" "+c.Path(), trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if e, ok := err.(*fiber.Error); ok {
+			status = e.Code
+		}
+		span.SetName(c.Method() + " " + c.Route().Path)
+		span.SetAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Method()),
+			semconv.HTTPRoute(c.Route().Path),
+			semconv.HTTPResponseStatusCode(status),
+		)
+		if err != nil || status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// AnnotateEvent adds the event's identifiers to the span in ctx.
+func AnnotateEvent(ctx context.Context, eventType, adID string) {
+	trace.SpanFromContext(ctx).SetAttributes(
+		attribute.String("event.type", eventType),
+		attribute.String("ad.id", adID),
+	)
+}
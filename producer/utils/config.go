@@ -1,9 +1,10 @@
 package utils
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -15,12 +16,26 @@ type Config struct {
     MongoURI     string
     MongoDB      string
     ProducerPort string
+
+    LogLevel       string
+    LogSampleEvery int
+
+    PixelQueueSize int
+
+    SpoolDir           string
+    SpoolMaxBytes      int64
+    SpoolDrainInterval time.Duration
+
+    TraceExporter    string
+    TraceSampleRatio float64
+
+    ReadyTimeout    time.Duration
+    ShutdownTimeout time.Duration
 }
 
 func LoadConfig() Config {
-	fmt.Println("!!!!!!!!!!!@IN nev")
     if err := godotenv.Load("/app/.env"); err != nil {
-        log.Println(err,"No .env file found, using environment variables")
+        slog.Debug("No .env file found, using environment variables", "error", err)
     }
 
     return Config{
@@ -30,6 +45,24 @@ func LoadConfig() Config {
         MongoURI:     getEnv("MONGO_URI", "mongodb://localhost:27017"),
         MongoDB:      getEnv("MONGO_DB", "video_ads"),
         ProducerPort: getEnv("PRODUCER_PORT", "8080"),
+
+        LogLevel:       getEnv("LOG_LEVEL", "info"),
+        LogSampleEvery: getEnvInt("LOG_SAMPLE_EVERY", 100),
+
+        PixelQueueSize: getEnvPositiveInt("PIXEL_QUEUE_SIZE", 10000),
+
+        // SPOOL_DIR is relative to the working directory, /app in the
+        // image. An empty SPOOL_DIR disables spooling, so publish failures
+        // are returned to the client.
+        SpoolDir:           getEnv("SPOOL_DIR", "spool"),
+        SpoolMaxBytes:      int64(getEnvInt("SPOOL_MAX_BYTES", 1<<30)),
+        SpoolDrainInterval: getEnvDuration("SPOOL_DRAIN_INTERVAL", time.Second),
+
+        TraceExporter:    getEnv("TRACE_EXPORTER", "none"),
+        TraceSampleRatio: getEnvFloat("TRACE_SAMPLE_RATIO", 1),
+
+        ReadyTimeout:    getEnvDuration("READY_TIMEOUT", 2*time.Second),
+        ShutdownTimeout: getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
     }
 }
 
@@ -39,3 +72,43 @@ func getEnv(key, fallback string) string {
     }
     return fallback
 }
+
+func getEnvInt(key string, fallback int) int {
+    if value, exists := os.LookupEnv(key); exists {
+        if n, err := strconv.Atoi(value); err == nil {
+            return n
+        }
+        slog.Warn("Invalid integer, using default", "key", key, "value", value, "default", fallback)
+    }
+    return fallback
+}
+
+// getEnvPositiveInt is getEnvInt for sizes that must be at least one.
+func getEnvPositiveInt(key string, fallback int) int {
+    n := getEnvInt(key, fallback)
+    if n < 1 {
+        slog.Warn("Value must be positive, using default", "key", key, "value", n, "default", fallback)
+        return fallback
+    }
+    return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+    if value, exists := os.LookupEnv(key); exists {
+        if f, err := strconv.ParseFloat(value, 64); err == nil {
+            return f
+        }
+        slog.Warn("Invalid number, using default", "key", key, "value", value, "default", fallback)
+    }
+    return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+    if value, exists := os.LookupEnv(key); exists {
+        if d, err := time.ParseDuration(value); err == nil && d > 0 {
+            return d
+        }
+        slog.Warn("Invalid duration, using default", "key", key, "value", value, "default", fallback)
+    }
+    return fallback
+}